@@ -0,0 +1,244 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CCI describes a CCI file, also known as a cartridge image.
+type CCI struct {
+	TitleID    Hex64
+	MediaSize  int64
+	MediaUnit  int64
+	MediaType  uint8
+	CardDevice uint8
+	Trimmed    bool
+	CardInfo   CCICardInfo
+	Partitions []CCIPartition
+	Icon       *SMDH
+	Updates    []CCIUpdate
+}
+
+// CCICardInfo describes the card info header of a CCI file.
+type CCICardInfo struct {
+	WritableAddress int64
+	Flags           Hex32
+	FilledSize      uint32
+	TitleVersion    uint16
+	CardRevision    uint16
+	CVerTitleID     Hex64
+	CVerVersion     uint16
+	CardSeedKeyY    Hex
+}
+
+// CCIPartition describes a partition of a CCI file.
+type CCIPartition struct {
+	Index      int
+	ID         Hex64
+	FSType     uint8
+	CryptType  uint8
+	Offset     int64
+	Size       int64
+	ProgramID  Hex64
+	Legit      bool
+	Encrypted  bool
+	ExHeader   *ExHeader
+	Unverified []string
+}
+
+// CCIUpdate describes a CIA file found in the update partition of a CCI file.
+type CCIUpdate struct {
+	Path         string
+	Size         int64
+	TitleID      Hex64
+	TitleVersion uint16
+}
+
+// CheckCCI reads the given CCI file and verifies its structure.
+//
+// The NCSD header and the card info header are parsed, and each partition is verified as an NCCH
+// (see CheckNCCH). The program ID of each partition must match the title ID of the CCI file. The
+// file may be trimmed after the last partition, otherwise it must be padded with 0xff bytes up to
+// the media size. The CIA files found in the update partition are listed in Updates.
+func CheckCCI(r io.ReaderAt, size int64, options *Options) (*CCI, error) {
+	options = options.orDefault()
+
+	header := make([]byte, 0x1200)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cci: failed to read header: %w", err)
+	}
+
+	if string(header[0x100:0x104]) != "NCSD" {
+		return nil, fmt.Errorf("cci: magic not found")
+	}
+
+	flags := header[0x188:0x190]
+	mediaUnit := int64(0x200) << flags[6]
+	mediaSize := int64(binary.LittleEndian.Uint32(header[0x104:])) * mediaUnit
+	titleID := binary.LittleEndian.Uint64(header[0x108:])
+
+	if titleID == 0 {
+		return nil, fmt.Errorf("cci: missing title ID, NAND images are not supported")
+	}
+
+	cardInfo := header[0x200:0x1000]
+	initialData := header[0x1000:0x1200]
+
+	cci := &CCI{
+		TitleID:    Hex64(titleID),
+		MediaSize:  mediaSize,
+		MediaUnit:  mediaUnit,
+		MediaType:  flags[5],
+		CardDevice: flags[3],
+		Trimmed:    size < mediaSize,
+		CardInfo: CCICardInfo{
+			WritableAddress: int64(binary.LittleEndian.Uint32(cardInfo)) * mediaUnit,
+			Flags:           Hex32(binary.LittleEndian.Uint32(cardInfo[0x4:])),
+			FilledSize:      binary.LittleEndian.Uint32(cardInfo[0x100:]),
+			TitleVersion:    binary.LittleEndian.Uint16(cardInfo[0x110:]),
+			CardRevision:    binary.LittleEndian.Uint16(cardInfo[0x112:]),
+			CVerTitleID:     Hex64(binary.LittleEndian.Uint64(cardInfo[0x120:])),
+			CVerVersion:     binary.LittleEndian.Uint16(cardInfo[0x128:]),
+			CardSeedKeyY:    append([]byte(nil), initialData[:0x10]...),
+		},
+		Partitions: make([]CCIPartition, 0, 8),
+	}
+
+	if size > mediaSize && !options.AllowExtraneousData {
+		return nil, &ExtraneousDataError{
+			Location: Location{Structure: "cci", Offset: mediaSize},
+		}
+	}
+
+	partitionsEnd := int64(0x4000)
+	for index := 0; index < 8; index++ {
+		offset := int64(binary.LittleEndian.Uint32(header[0x120+index*0x8:])) * mediaUnit
+		length := int64(binary.LittleEndian.Uint32(header[0x124+index*0x8:])) * mediaUnit
+		if length == 0 {
+			continue
+		}
+
+		if offset < partitionsEnd {
+			return nil, fmt.Errorf("cci: partition %d overlaps previous data", index)
+		}
+		if offset+length > size {
+			return nil, fmt.Errorf("cci: partition %d exceeds file size", index)
+		}
+		partitionsEnd = offset + length
+
+		data := io.NewSectionReader(r, offset, length)
+		ncch, err := CheckNCCHWithOptions(data, length, options)
+		if err != nil {
+			return nil, fmt.Errorf("cci: invalid partition %d: %w", index, err)
+		}
+
+		partitionID := binary.LittleEndian.Uint64(header[0x190+index*0x8:])
+		if ncch.PartitionID != Hex64(partitionID) {
+			return nil, fmt.Errorf("cci: partition %d has unexpected partition ID: %s != %s", index, ncch.PartitionID, Hex64(partitionID))
+		}
+		if ncch.ProgramID != cci.TitleID {
+			return nil, fmt.Errorf("cci: partition %d has unexpected program ID: %s != %s", index, ncch.ProgramID, cci.TitleID)
+		}
+
+		if index == 0 {
+			ncchHeader := make([]byte, 0x100)
+			_, err = data.ReadAt(ncchHeader, 0x100)
+			if err != nil {
+				return nil, fmt.Errorf("cci: failed to read header of partition %d: %w", index, err)
+			}
+			if !bytes.Equal(ncchHeader, initialData[0x100:0x200]) {
+				return nil, fmt.Errorf("cci: initial data does not match header of partition %d", index)
+			}
+
+			if ncch.ExeFS != nil {
+				cci.Icon = ncch.ExeFS.Icon
+			}
+		}
+
+		if index == 7 {
+			cci.Updates, err = listCCIUpdates(data, length)
+			if err != nil {
+				return nil, fmt.Errorf("cci: invalid partition %d: %w", index, err)
+			}
+		}
+
+		cci.Partitions = append(cci.Partitions, CCIPartition{
+			Index:      index,
+			ID:         Hex64(partitionID),
+			FSType:     header[0x110+index],
+			CryptType:  header[0x118+index],
+			Offset:     offset,
+			Size:       length,
+			ProgramID:  ncch.ProgramID,
+			Legit:      ncch.Legit,
+			Encrypted:  ncch.Encrypted,
+			ExHeader:   ncch.ExHeader,
+			Unverified: ncch.Unverified,
+		})
+	}
+
+	paddingEnd := size
+	if paddingEnd > mediaSize {
+		paddingEnd = mediaSize
+	}
+	padding := io.NewSectionReader(r, partitionsEnd, paddingEnd-partitionsEnd)
+	buf := make([]byte, 0x10000)
+	for offset := partitionsEnd; offset < paddingEnd; {
+		n, err := padding.Read(buf)
+		for i, b := range buf[:n] {
+			if b != 0xff {
+				return nil, fmt.Errorf("cci: unexpected padding byte at offset %d: %s", offset+int64(i), Hex8(b))
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cci: failed to read padding: %w", err)
+		}
+	}
+
+	return cci, nil
+}
+
+// listCCIUpdates lists the CIA files found in the RomFS of the given update partition.
+func listCCIUpdates(r io.ReaderAt, size int64) ([]CCIUpdate, error) {
+	romfs, err := ncchRomFSReader(r, size)
+	if err != nil || romfs == nil {
+		return nil, err
+	}
+
+	level3, err := openRomFS(romfs, romfs.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make([]CCIUpdate, 0)
+	err = level3.walk(func(file romfsFile) error {
+		if !strings.HasSuffix(strings.ToLower(file.path), ".cia") {
+			return nil
+		}
+
+		cia, err := OpenCIA(level3.open(file), file.size)
+		if err != nil {
+			return fmt.Errorf("invalid update %s: %w", file.path, err)
+		}
+
+		updates = append(updates, CCIUpdate{
+			Path:         file.path,
+			Size:         file.size,
+			TitleID:      cia.TMD.TitleID,
+			TitleVersion: cia.TMD.TitleVersion,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return updates, nil
+}
@@ -0,0 +1,204 @@
+package ctrsigcheck
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// CDN describes a set of files downloaded from Nintendo's CDN.
+type CDN struct {
+	Legit       bool
+	Complete    bool
+	Environment Environment
+	TitleID     Hex64
+	Ticket      CIATicket
+	TMD         CIATMD
+	Contents    []CIAContent
+	Icon        *SMDH
+}
+
+// CheckCDN reads the CDN files found in the given directory and verifies them as a whole.
+//
+// The directory must contain a ticket named "cetk", a TMD and one file per content, named after
+// its ID in 8 hexadecimal digits (either lowercase or uppercase). The TMD is read from "tmd" if
+// present, or from the "tmd.<version>" file with the highest version otherwise.
+//
+// Contents are decrypted with the title key of the ticket, and verified exactly as CheckCIA
+// would. Missing optional contents are reported through the Missing booleans.
+func CheckCDN(dir string, options *Options) (*CDN, error) {
+	tmdPath := filepath.Join(dir, "tmd")
+	if _, err := os.Stat(tmdPath); err == nil {
+		return checkCDN(dir, tmdPath, -1, options.orDefault())
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cdn: failed to list files: %w", err)
+	}
+
+	version := -1
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "tmd.") {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimPrefix(entry.Name(), "tmd."), 10, 16)
+		if err == nil && int(v) > version {
+			version = int(v)
+		}
+	}
+	if version < 0 {
+		return nil, fmt.Errorf("cdn: TMD not found")
+	}
+
+	return checkCDN(dir, filepath.Join(dir, fmt.Sprintf("tmd.%d", version)), version, options.orDefault())
+}
+
+// CheckCDNVersion is like CheckCDN, but it reads the TMD of the given version, from the
+// "tmd.<version>" file.
+func CheckCDNVersion(dir string, version uint16, options *Options) (*CDN, error) {
+	return checkCDN(dir, filepath.Join(dir, fmt.Sprintf("tmd.%d", version)), int(version), options.orDefault())
+}
+
+func checkCDN(dir, tmdPath string, version int, options *Options) (*CDN, error) {
+	ticketFile, err := os.Open(filepath.Join(dir, "cetk"))
+	if err != nil {
+		return nil, fmt.Errorf("cdn: failed to open ticket: %w", err)
+	}
+	defer ticketFile.Close()
+
+	ticket, err := CheckTicketWithOptions(ticketFile, options)
+	if err != nil {
+		return nil, err
+	}
+
+	tmdFile, err := os.Open(tmdPath)
+	if err != nil {
+		return nil, fmt.Errorf("cdn: failed to open TMD: %w", err)
+	}
+	defer tmdFile.Close()
+
+	tmd, err := CheckTMDWithOptions(tmdFile, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if version >= 0 && int(tmd.TitleVersion) != version {
+		return nil, fmt.Errorf("cdn: TMD version does not match its file name: %d != %d", tmd.TitleVersion, version)
+	}
+
+	if ticket.TitleID != tmd.TitleID {
+		return nil, fmt.Errorf("cdn: ticket and TMD have different title IDs: %s != %s", ticket.TitleID, tmd.TitleID)
+	}
+
+	if ticket.Environment != tmd.Environment {
+		return nil, fmt.Errorf("cdn: ticket and TMD have different environments: %s != %s", ticket.Environment, tmd.Environment)
+	}
+
+	cdn := &CDN{
+		Legit:       ticket.Legit && tmd.Legit,
+		Complete:    true,
+		Environment: tmd.Environment,
+		TitleID:     tmd.TitleID,
+		Ticket: CIATicket{
+			Legit:       ticket.Legit,
+			Environment: ticket.Environment,
+			TicketID:    ticket.TicketID,
+			ConsoleID:   ticket.ConsoleID,
+			TitleKey:    ticket.TitleKey,
+		},
+		TMD: CIATMD{
+			Legit:        tmd.Legit,
+			Original:     tmd.Original,
+			Environment:  tmd.Environment,
+			TitleVersion: tmd.TitleVersion,
+		},
+		Contents: make([]CIAContent, len(tmd.Contents)),
+	}
+
+	for index, content := range tmd.Contents {
+		cdnContent := &cdn.Contents[index]
+		cdnContent.TMDContent = content
+
+		file, err := openCDNContent(dir, content.ID)
+		if os.IsNotExist(err) {
+			cdnContent.Missing = true
+			cdn.Complete = false
+			if !content.Optional && !options.AllowMissingContents {
+				return nil, &MissingContentError{
+					Location: contentLocation("cdn", &content, 0),
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cdn: failed to open content %s: %w", content.ID, err)
+		}
+
+		ncch, icon, err := checkCDNContent(file, &content, ticket.TitleKey.Decrypted, tmd.TitleID, options)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		cdnContent.NCCH = ncch
+		if content.Index == 0x0000 && icon != nil {
+			cdn.Icon = icon
+		}
+	}
+
+	return cdn, nil
+}
+
+// openCDNContent opens the file of the given content, named after its ID in either lowercase or
+// uppercase.
+func openCDNContent(dir string, id Hex32) (*os.File, error) {
+	name := fmt.Sprintf("%08x", uint32(id))
+	file, err := os.Open(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		file, err = os.Open(filepath.Join(dir, strings.ToUpper(name)))
+	}
+	return file, err
+}
+
+func checkCDNContent(input io.Reader, content *TMDContent, titleKey []byte, titleID Hex64, options *Options) (*CIAContentNCCH, *SMDH, error) {
+	if content.Size >= 1<<63 {
+		return nil, nil, fmt.Errorf("cdn: size of content %s too large: %d", content.ID, content.Size)
+	}
+	size := int64(content.Size)
+
+	reader := ctrutil.NewReader(input)
+	data := ctrutil.NewReader(io.LimitReader(reader, size))
+
+	ncch, icon, err := checkContent(data, content, titleKey, titleID, "cdn", 0, options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = data.Discard(size - data.Offset())
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("cdn: failed to read content %s: %w", content.ID, err)
+	}
+
+	if !options.AllowExtraneousData {
+		err = reader.Discard(1)
+		if err == nil {
+			return nil, nil, &ExtraneousDataError{
+				Location: contentLocation("cdn", content, size),
+			}
+		} else if err != io.EOF {
+			return nil, nil, fmt.Errorf("cdn: failed to check extraneous data: %w", err)
+		}
+	}
+
+	return ncch, icon, nil
+}
@@ -10,15 +10,30 @@ import (
 	"github.com/connesc/ctrsigcheck/internal/bindata"
 )
 
+// Environment designates the set of certificates that signed a ticket or a TMD.
+type Environment string
+
+// Known environments.
+const (
+	Retail Environment = "Retail"
+	Debug  Environment = "Debug"
+)
+
 // Certificate used to verify digital signatures.
+//
+// PublicKey is only set for RSA keys.
 type Certificate struct {
-	Name      string
-	PublicKey rsa.PublicKey
-	Raw       []byte
+	Name          string
+	Issuer        string
+	SignatureType SignatureType
+	KeyType       KeyType
+	PublicKey     rsa.PublicKey
+	Raw           []byte
 }
 
 // CertificateSet used to verify digital signatures of tickets and TMDs.
 type CertificateSet struct {
+	Environment     Environment
 	CA, Ticket, TMD Certificate
 }
 
@@ -30,49 +45,124 @@ var Certs struct {
 
 func init() {
 	certs := bindata.MustAsset("certs.bin")
+	Certs.Debug.Environment = Debug
 	Certs.Debug.CA = parseCertificate(certs[0x10:0x410])
 	Certs.Debug.Ticket = parseCertificate(certs[0x410:0x710])
 	Certs.Debug.TMD = parseCertificate(certs[0x710:0xa10])
+	Certs.Retail.Environment = Retail
 	Certs.Retail.CA = parseCertificate(certs[0xa10:0xe10])
 	Certs.Retail.TMD = parseCertificate(certs[0xe10:0x1110])
 	Certs.Retail.Ticket = parseCertificate(certs[0x1110:0x1410])
 }
 
+func certificateSets() []*CertificateSet {
+	return []*CertificateSet{&Certs.Retail, &Certs.Debug}
+}
+
+// TicketIssuer returns the issuer expected in tickets signed by this certificate set.
+func (s *CertificateSet) TicketIssuer() string {
+	return fmt.Sprintf("Root-%s-%s", s.CA.Name, s.Ticket.Name)
+}
+
+// TMDIssuer returns the issuer expected in TMDs signed by this certificate set.
+func (s *CertificateSet) TMDIssuer() string {
+	return fmt.Sprintf("Root-%s-%s", s.CA.Name, s.TMD.Name)
+}
+
+// Chain returns the certificate chain, as embedded in CIA files.
+func (s *CertificateSet) Chain() []byte {
+	chain := make([]byte, 0, len(s.CA.Raw)+len(s.Ticket.Raw)+len(s.TMD.Raw))
+	chain = append(chain, s.CA.Raw...)
+	chain = append(chain, s.Ticket.Raw...)
+	chain = append(chain, s.TMD.Raw...)
+	return chain
+}
+
+func findCertificateSet(environment Environment) *CertificateSet {
+	for _, set := range certificateSets() {
+		if environment == set.Environment {
+			return set
+		}
+	}
+	return nil
+}
+
+func findTicketCertificateSet(issuer string) *CertificateSet {
+	for _, set := range certificateSets() {
+		if issuer == set.TicketIssuer() {
+			return set
+		}
+	}
+	return nil
+}
+
+func findTMDCertificateSet(issuer string) *CertificateSet {
+	for _, set := range certificateSets() {
+		if issuer == set.TMDIssuer() {
+			return set
+		}
+	}
+	return nil
+}
+
 func parseCertificate(raw []byte) Certificate {
-	signatureType := binary.BigEndian.Uint32(raw)
-
-	var signatureLen int64
-	switch signatureType {
-	case 0x10003:
-		signatureLen = 0x240
-	case 0x10004:
-		signatureLen = 0x140
-	default:
-		panic(fmt.Errorf("certs: unexpected signature type: 0x%08x", signatureType))
+	cert, err := ParseCertificate(raw)
+	if err != nil {
+		panic(err)
 	}
+	return cert
+}
 
-	keyType := binary.BigEndian.Uint32(raw[signatureLen+0x40:])
+// ParseCertificate parses the certificate found at the beginning of the given bytes.
+//
+// Trailing bytes are ignored, so that a certificate chain can be parsed by calling this function
+// repeatedly. The length of the certificate can then be obtained from the Raw field.
+func ParseCertificate(raw []byte) (Certificate, error) {
+	if len(raw) < 4 {
+		return Certificate{}, fmt.Errorf("certs: certificate too short: %d bytes", len(raw))
+	}
 
-	var modulusLen int64
+	signatureType := SignatureType(binary.BigEndian.Uint32(raw))
+	signatureLen := signatureType.sectionLen()
+	if signatureLen == 0 {
+		return Certificate{}, fmt.Errorf("certs: unexpected signature type: %s", Hex32(signatureType))
+	}
+	if len(raw) < signatureLen+0x88 {
+		return Certificate{}, fmt.Errorf("certs: certificate too short: %d bytes", len(raw))
+	}
+
+	issuer := string(bytes.TrimRight(raw[signatureLen:signatureLen+0x40], "\x00"))
+	keyType := KeyType(binary.BigEndian.Uint32(raw[signatureLen+0x40:]))
+	name := string(bytes.TrimRight(raw[signatureLen+0x44:signatureLen+0x84], "\x00"))
+
+	keyLen := keyType.sectionLen()
+	if keyLen == 0 {
+		return Certificate{}, fmt.Errorf("certs: unexpected key type: %s", Hex32(keyType))
+	}
+	certLen := signatureLen + 0x88 + keyLen
+	if len(raw) < certLen {
+		return Certificate{}, fmt.Errorf("certs: certificate too short: %d bytes", len(raw))
+	}
+
+	var publicKey rsa.PublicKey
+	var modulusLen int
 	switch keyType {
-	case 0x0:
+	case RSA4096:
 		modulusLen = 0x200
-	case 0x1:
+	case RSA2048:
 		modulusLen = 0x100
-	default:
-		panic(fmt.Errorf("certs: unexpected key type: 0x%08x", keyType))
 	}
-
-	name := string(bytes.TrimRight(raw[signatureLen+0x44:signatureLen+0x84], "\x00"))
-	modulus := new(big.Int).SetBytes(raw[signatureLen+0x88 : signatureLen+0x88+modulusLen])
-	exponent := binary.BigEndian.Uint32(raw[signatureLen+0x88+modulusLen:])
+	if modulusLen > 0 {
+		publicKey.N = new(big.Int).SetBytes(raw[signatureLen+0x88 : signatureLen+0x88+modulusLen])
+		publicKey.E = int(binary.BigEndian.Uint32(raw[signatureLen+0x88+modulusLen:]))
+	}
 
 	return Certificate{
-		Name: name,
-		PublicKey: rsa.PublicKey{
-			N: modulus,
-			E: int(exponent),
-		},
-		Raw: raw,
-	}
+		Name:          name,
+		Issuer:        issuer,
+		SignatureType: signatureType,
+		KeyType:       keyType,
+		PublicKey:     publicKey,
+		Raw:           raw[:certLen],
+	}, nil
 }
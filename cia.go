@@ -17,28 +17,31 @@ import (
 
 // CIA describes a CIA file.
 type CIA struct {
-	Legit    bool
-	Complete bool
-	TitleID  Hex64
-	Ticket   CIATicket
-	TMD      CIATMD
-	Contents []CIAContent
-	Icon     *SMDH
-	Meta     bool
+	Legit       bool
+	Complete    bool
+	Environment Environment
+	TitleID     Hex64
+	Ticket      CIATicket
+	TMD         CIATMD
+	Contents    []CIAContent
+	Icon        *SMDH
+	Meta        *CIAMeta
 }
 
 // CIATicket describes the ticket embedded in a CIA file.
 type CIATicket struct {
-	Legit     bool
-	TicketID  Hex64
-	ConsoleID Hex32
-	TitleKey  TitleKey
+	Legit       bool
+	Environment Environment
+	TicketID    Hex64
+	ConsoleID   Hex32
+	TitleKey    TitleKey
 }
 
 // CIATMD describes the TMD embedded in a CIA file.
 type CIATMD struct {
 	Legit        bool
 	Original     bool
+	Environment  Environment
 	TitleVersion uint16
 }
 
@@ -51,7 +54,17 @@ type CIAContent struct {
 
 // CIAContentNCCH describes the NCCH structure of a content section embedded in a CIA file.
 type CIAContentNCCH struct {
-	Encrypted bool
+	Legit      bool
+	Encrypted  bool
+	ExHeader   *ExHeader
+	Unverified []string
+}
+
+// CIAMeta describes the meta section embedded in a CIA file.
+type CIAMeta struct {
+	Dependencies []Hex64
+	CoreVersion  uint32
+	Icon         *SMDH
 }
 
 // CheckCIA reads the given CIA file and verifies its content.
@@ -60,6 +73,9 @@ type CIAContentNCCH struct {
 // problem is detected, an error is immediately returned. Otherwise, a summary of the CIA file is
 // returned.
 //
+// Both retail and debug certificate chains are accepted, as reported by Environment. The ticket and
+// the TMD must be signed in the same environment as the embedded certificate chain.
+//
 // Nintendo signatures are not required to be valid. Their status are made available to the caller
 // through the Legit booleans.
 //
@@ -67,18 +83,51 @@ type CIAContentNCCH struct {
 // contains the hashes of content segments, a "legit" TMD also guarantees a "legit" content. A
 // "legit" ticket means that content is legitimately owned, either personnally (e.g. game or update
 // downloaded from eShop) or not (e.g. preinstalled game or system title).
+//
+// Contents are also verified as NCCH files (see CheckNCCH), which provides some integrity even
+// when the TMD is not "legit". Programs may also be proven "legit" by their own NCCH signatures.
 func CheckCIA(input io.Reader) (*CIA, error) {
+	return CheckCIAWithOptions(input, nil)
+}
+
+// CheckCIAWithOptions is like CheckCIA, but its behavior can be adjusted with the given options.
+// A nil options is equivalent to the zero value.
+func CheckCIAWithOptions(input io.Reader, options *Options) (*CIA, error) {
+	cia, err := checkCIA(input, options.orDefault(), &findings{})
+	if err != nil {
+		return nil, err
+	}
+	return cia, nil
+}
+
+// ValidateCIA is like CheckCIAWithOptions, but it doesn't stop at the first problem.
+//
+// Instead, the verification goes on as far as the file structure allows, and every detected
+// problem is returned as a Finding. Problems tolerated by the given options are reported as
+// warnings. The returned summary is never nil, but only contains whatever could be determined.
+func ValidateCIA(input io.Reader, options *Options) (*CIA, []Finding) {
+	findings := &findings{collect: true}
+	cia, err := checkCIA(input, options.orDefault(), findings)
+	if err != nil {
+		findings.fatal(err)
+	}
+	return cia, findings.list
+}
+
+func checkCIA(input io.Reader, options *Options, findings *findings) (*CIA, error) {
 	reader := ctrutil.NewReader(input)
+	cia := &CIA{}
 
+	findings.enter("header", 0)
 	header := make([]byte, 0x2020)
 	_, err := io.ReadFull(reader, header)
 	if err != nil {
-		return nil, fmt.Errorf("cia: failed to read header: %w", err)
+		return cia, fmt.Errorf("cia: failed to read header: %w", err)
 	}
 
 	headerLen := binary.LittleEndian.Uint32(header)
 	if headerLen != 0x2020 {
-		return nil, fmt.Errorf("cia: header length must be %d, got %d", 0x2020, headerLen)
+		return cia, fmt.Errorf("cia: header length must be %d, got %d", 0x2020, headerLen)
 	}
 
 	certsLen := binary.LittleEndian.Uint32(header[0x8:])
@@ -88,87 +137,174 @@ func CheckCIA(input io.Reader) (*CIA, error) {
 	contentLen := binary.LittleEndian.Uint64(header[0x18:])
 	contentIndex := header[0x20:]
 
-	expectedCertsLen := uint32(len(Certs.Retail.CA.Raw) + len(Certs.Retail.Ticket.Raw) + len(Certs.Retail.TMD.Raw))
+	err = reader.Discard((0x40 - (reader.Offset() % 0x40)) % 0x40)
+	if err != nil {
+		return cia, fmt.Errorf("cia: failed to skip header padding: %w", err)
+	}
+
+	certsOffset := reader.Offset()
+	findings.enter("certs", certsOffset)
+
+	// The length is checked before reading, so that the certs can be buffered safely.
+	var certSet *CertificateSet
+	expectedCertsLen := uint32(len(Certs.Retail.Chain()))
 	if certsLen != expectedCertsLen {
-		return nil, fmt.Errorf("cia: certs length must be %d, got %d", expectedCertsLen, certsLen)
+		err = findings.problem("certs", certsOffset, fmt.Errorf("cia: certs length must be %d, got %d", expectedCertsLen, certsLen))
+		if err != nil {
+			return cia, err
+		}
+
+		err = reader.Discard(int64(certsLen))
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return cia, fmt.Errorf("cia: failed to read certs: %w", err)
+		}
+	} else {
+		certs := make([]byte, certsLen)
+		_, err = io.ReadFull(reader, certs)
+		if err != nil {
+			return cia, fmt.Errorf("cia: failed to read certs: %w", err)
+		}
+
+		certSet, err = checkCIACerts(certs)
+		if err != nil {
+			if err := findings.problem("certs", certsOffset, err); err != nil {
+				return cia, err
+			}
+		} else {
+			cia.Environment = certSet.Environment
+		}
 	}
 
 	err = reader.Discard((0x40 - (reader.Offset() % 0x40)) % 0x40)
 	if err != nil {
-		return nil, fmt.Errorf("cia: failed to skip TMD padding: %w", err)
+		return cia, fmt.Errorf("cia: failed to skip certs padding: %w", err)
 	}
 
-	certs := make([]byte, certsLen)
-	_, err = io.ReadFull(reader, certs)
+	// Legit signatures are required at the CIA level, so that this problem can be collected.
+	embeddedOptions := *options
+	embeddedOptions.RequireLegit = false
+
+	ticketOffset := reader.Offset()
+	findings.enter("ticket", ticketOffset)
+	ticket, err := CheckTicketWithOptions(io.LimitReader(reader, int64(ticketLen)), &embeddedOptions)
 	if err != nil {
-		return nil, fmt.Errorf("cia: failed to read certs: %w", err)
+		return cia, err
 	}
 
-	caCertLen := len(Certs.Retail.CA.Raw)
-	if !bytes.Equal(certs[:caCertLen], Certs.Retail.CA.Raw) {
-		return nil, fmt.Errorf("cia: invalid CA certificate")
+	cia.Ticket = CIATicket{
+		Legit:       ticket.Legit,
+		Environment: ticket.Environment,
+		TicketID:    ticket.TicketID,
+		ConsoleID:   ticket.ConsoleID,
+		TitleKey:    ticket.TitleKey,
 	}
 
-	ticketCertLen := len(Certs.Retail.Ticket.Raw)
-	if !bytes.Equal(certs[caCertLen:caCertLen+ticketCertLen], Certs.Retail.Ticket.Raw) {
-		return nil, fmt.Errorf("cia: invalid ticket certificate")
+	if ticket.CertsTrailer {
+		err = findings.problem("ticket", ticketOffset, fmt.Errorf("cia: unexpected certs trailer in ticket"))
+		if err != nil {
+			return cia, err
+		}
 	}
 
-	tmdCertLen := len(Certs.Retail.TMD.Raw)
-	if !bytes.Equal(certs[caCertLen+ticketCertLen:caCertLen+ticketCertLen+tmdCertLen], Certs.Retail.TMD.Raw) {
-		return nil, fmt.Errorf("cia: invalid TMD certificate")
+	if certSet != nil && ticket.Environment != certSet.Environment {
+		err = findings.problem("ticket", ticketOffset, fmt.Errorf("cia: ticket environment does not match certificates: %s != %s", ticket.Environment, certSet.Environment))
+		if err != nil {
+			return cia, err
+		}
 	}
 
-	err = reader.Discard((0x40 - (reader.Offset() % 0x40)) % 0x40)
-	if err != nil {
-		return nil, fmt.Errorf("cia: failed to skip certs padding: %w", err)
+	if options.RequireLegit && !ticket.Legit {
+		err = findings.problem("ticket", ticketOffset, fmt.Errorf("ticket: signature is not legit"))
+		if err != nil {
+			return cia, err
+		}
 	}
 
-	ticket, err := CheckTicket(io.LimitReader(reader, int64(ticketLen)))
-	if err != nil {
-		return nil, err
+	err = reader.Discard(int64(ticketLen) - (reader.Offset() - ticketOffset))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-
-	if ticket.CertsTrailer {
-		return nil, fmt.Errorf("cia: unexpected certs trailer in ticket")
+	if err != nil {
+		return cia, fmt.Errorf("cia: failed to read ticket: %w", err)
 	}
 
 	err = reader.Discard((0x40 - (reader.Offset() % 0x40)) % 0x40)
 	if err != nil {
-		return nil, fmt.Errorf("cia: failed to skip ticket padding: %w", err)
+		return cia, fmt.Errorf("cia: failed to skip ticket padding: %w", err)
 	}
 
-	tmd, err := CheckTMD(io.LimitReader(reader, int64(tmdLen)))
+	tmdOffset := reader.Offset()
+	findings.enter("tmd", tmdOffset)
+	tmd, err := CheckTMDWithOptions(io.LimitReader(reader, int64(tmdLen)), &embeddedOptions)
 	if err != nil {
-		return nil, err
+		return cia, err
+	}
+
+	cia.TMD = CIATMD{
+		Legit:        tmd.Legit,
+		Original:     tmd.Original,
+		Environment:  tmd.Environment,
+		TitleVersion: tmd.TitleVersion,
 	}
 
 	if tmd.CertsTrailer {
-		return nil, fmt.Errorf("cia: unexpected certs trailer in TMD")
+		err = findings.problem("tmd", tmdOffset, fmt.Errorf("cia: unexpected certs trailer in TMD"))
+		if err != nil {
+			return cia, err
+		}
+	}
+
+	if certSet != nil && tmd.Environment != certSet.Environment {
+		err = findings.problem("tmd", tmdOffset, fmt.Errorf("cia: TMD environment does not match certificates: %s != %s", tmd.Environment, certSet.Environment))
+		if err != nil {
+			return cia, err
+		}
+	}
+
+	if options.RequireLegit && !tmd.Legit {
+		err = findings.problem("tmd", tmdOffset, fmt.Errorf("tmd: signature is not legit"))
+		if err != nil {
+			return cia, err
+		}
+	}
+
+	err = reader.Discard(int64(tmdLen) - (reader.Offset() - tmdOffset))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return cia, fmt.Errorf("cia: failed to read TMD: %w", err)
 	}
 
 	err = reader.Discard((0x40 - (reader.Offset() % 0x40)) % 0x40)
 	if err != nil {
-		return nil, fmt.Errorf("cia: failed to skip TMD padding: %w", err)
+		return cia, fmt.Errorf("cia: failed to skip TMD padding: %w", err)
 	}
 
 	titleID := tmd.TitleID
+	cia.TitleID = titleID
 	if ticket.TitleID != titleID {
-		return nil, fmt.Errorf("cia: ticket and TMD have different title IDs: %s != %s", ticket.TitleID, tmd.TitleID)
+		err = findings.problem("ticket", ticketOffset, fmt.Errorf("cia: ticket and TMD have different title IDs: %s != %s", ticket.TitleID, tmd.TitleID))
+		if err != nil {
+			return cia, err
+		}
 	}
 
-	legit := ticket.Legit && tmd.Legit
+	cia.Legit = ticket.Legit && tmd.Legit
 
 	indexLen := (len(tmd.Contents) + 7) / 8
 	lastIndexBits := len(tmd.Contents) % 8
-	if lastIndexBits != 0 {
-		if contentIndex[indexLen-1]<<lastIndexBits != 0 {
-			return nil, fmt.Errorf("cia: content index contains more than %d entries", len(tmd.Contents))
-		}
-	}
+	extraIndexEntries := lastIndexBits != 0 && contentIndex[indexLen-1]<<lastIndexBits != 0
 	for _, indexByte := range contentIndex[indexLen:] {
-		if indexByte != 0 {
-			return nil, fmt.Errorf("cia: content index contains more than %d entries", len(tmd.Contents))
+		extraIndexEntries = extraIndexEntries || indexByte != 0
+	}
+	if extraIndexEntries {
+		err = findings.problem("header", 0x20, fmt.Errorf("cia: content index contains more than %d entries", len(tmd.Contents)))
+		if err != nil {
+			return cia, err
 		}
 	}
 
@@ -179,10 +315,18 @@ func CheckCIA(input io.Reader) (*CIA, error) {
 		missing := contentIndex[content.Index/8]&(1<<(7-(content.Index%8))) == 0
 		if !missing {
 			contentsSize += content.Size
-		} else if !content.Optional {
-			return nil, fmt.Errorf("cia: required content %s is missing", content.ID)
 		} else {
 			complete = false
+			if !content.Optional {
+				missingErr := &MissingContentError{
+					Location: contentLocation("cia", &content, int64(0x20+content.Index/8)),
+				}
+				if options.AllowMissingContents {
+					findings.tolerated("header", 0x20, missingErr)
+				} else if err := findings.problem("header", 0x20, missingErr); err != nil {
+					return cia, err
+				}
+			}
 		}
 		contents[index] = CIAContent{
 			Missing:    missing,
@@ -190,12 +334,16 @@ func CheckCIA(input io.Reader) (*CIA, error) {
 		}
 	}
 
+	cia.Complete = complete
+	cia.Contents = contents
+
 	if contentsSize != contentLen {
-		return nil, fmt.Errorf("cia: total size of contents does not match expected value: %d != %d", contentsSize, contentLen)
+		err = findings.problem("header", 0x18, fmt.Errorf("cia: total size of contents does not match expected value: %d != %d", contentsSize, contentLen))
+		if err != nil {
+			return cia, err
+		}
 	}
 
-	var icon *SMDH
-
 	for index := range contents {
 		content := &contents[index]
 		if content.Missing {
@@ -203,100 +351,253 @@ func CheckCIA(input io.Reader) (*CIA, error) {
 		}
 
 		if content.Size >= 1<<63 {
-			return nil, fmt.Errorf("cia: size of content %s too large: %d", content.ID, content.Size)
+			return cia, fmt.Errorf("cia: size of content %s too large: %d", content.ID, content.Size)
 		}
 
+		section := fmt.Sprintf("content %s", content.ID)
+		contentOffset := reader.Offset()
+		findings.enter(section, contentOffset)
 		size := int64(content.Size)
-		data := io.LimitReader(reader, size)
+		data := ctrutil.NewReader(io.LimitReader(reader, size))
 
-		if content.Encrypted {
-			contentCipher, err := aes.NewCipher(ticket.TitleKey.Decrypted)
-			if err != nil {
-				return nil, fmt.Errorf("cia: failed to initialize AES cipher for content %s: %w", content.ID, err)
-			}
-			if size%int64(contentCipher.BlockSize()) != 0 {
-				return nil, fmt.Errorf("cia: length of content %s must be a multiple of the AES block size: %d %% %d != 0", content.ID, size, contentCipher.BlockSize())
+		ncch, icon, err := checkContent(data, &content.TMDContent, ticket.TitleKey.Decrypted, titleID, "cia", contentOffset, options)
+		if err != nil {
+			if err := findings.problem(section, contentOffset, err); err != nil {
+				return cia, err
 			}
-			contentIV := make([]byte, contentCipher.BlockSize())
-			binary.BigEndian.PutUint16(contentIV, uint16(content.Index))
-			data = cipherio.NewBlockReader(data, cipher.NewCBCDecrypter(contentCipher, contentIV))
 		}
 
-		hash := sha256.New()
-		data = io.TeeReader(data, hash)
+		content.NCCH = ncch
+		if content.Index == 0x0000 && icon != nil {
+			cia.Icon = icon
+		}
 
-		dataReader := ctrutil.NewReader(data)
-		ncch, err := ParseNCCH(dataReader)
+		err = data.Discard(size - data.Offset())
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			return nil, fmt.Errorf("cia: invalid content %s: %w", content.ID, err)
+			return cia, fmt.Errorf("cia: failed to read content %s: %w", content.ID, err)
 		}
+	}
 
-		if ncch.ProgramID != titleID {
-			return nil, fmt.Errorf("cia: content %s has unecpected program ID: %s != %s", content.ID, ncch.ProgramID, titleID)
+	if metaLen > 0 {
+		err = reader.Discard((0x40 - (reader.Offset() % 0x40)) % 0x40)
+		if err != nil {
+			return cia, fmt.Errorf("cia: failed to skip contents padding: %w", err)
 		}
 
-		content.NCCH = &CIAContentNCCH{
-			Encrypted: ncch.Encrypted,
+		metaOffset := reader.Offset()
+		findings.enter("meta", metaOffset)
+
+		if metaLen != 0x3ac0 {
+			err = findings.problem("meta", metaOffset, fmt.Errorf("cia: when present, meta must have length %d, got %d", 0x3ac0, metaLen))
+			if err != nil {
+				return cia, err
+			}
+
+			err = reader.Discard(int64(metaLen))
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return cia, fmt.Errorf("cia: failed to read meta: %w", err)
+			}
+		} else {
+			cia.Meta, err = checkCIAMeta(reader, cia.Icon, options, findings)
+			if err != nil {
+				return cia, err
+			}
 		}
+	}
 
-		if content.Index == 0x0000 && ncch.ExeFS != nil {
-			icon = ncch.ExeFS.Icon
+	trailerOffset := reader.Offset()
+	findings.enter("trailer", trailerOffset)
+	if !options.AllowExtraneousData || findings.collect {
+		err = reader.Discard(1)
+		if err == nil {
+			extraneousErr := &ExtraneousDataError{
+				Location: Location{Structure: "cia", Offset: trailerOffset},
+			}
+			if options.AllowExtraneousData {
+				findings.tolerated("trailer", trailerOffset, extraneousErr)
+			} else if err := findings.problem("trailer", trailerOffset, extraneousErr); err != nil {
+				return cia, err
+			}
+		} else if err != io.EOF {
+			return cia, fmt.Errorf("cia: failed to check extraneous data: %w", err)
 		}
+	}
 
-		_, err = io.Copy(ioutil.Discard, dataReader)
-		if err == nil && dataReader.Offset() < size {
-			err = io.ErrUnexpectedEOF
+	return cia, nil
+}
+
+// checkCIACerts verifies the certificate chain embedded in a CIA file, and returns the matching
+// certificate set. The caller must have checked that certs has the length of a full chain.
+func checkCIACerts(certs []byte) (*CertificateSet, error) {
+	var certSet *CertificateSet
+	for _, set := range certificateSets() {
+		if bytes.Equal(certs[:len(set.CA.Raw)], set.CA.Raw) {
+			certSet = set
+			break
 		}
+	}
+	if certSet == nil {
+		return nil, fmt.Errorf("cia: invalid CA certificate")
+	}
+
+	caCertLen := len(certSet.CA.Raw)
+	ticketCertLen := len(certSet.Ticket.Raw)
+	if !bytes.Equal(certs[caCertLen:caCertLen+ticketCertLen], certSet.Ticket.Raw) {
+		return nil, fmt.Errorf("cia: invalid ticket certificate")
+	}
+
+	tmdCertLen := len(certSet.TMD.Raw)
+	if !bytes.Equal(certs[caCertLen+ticketCertLen:caCertLen+ticketCertLen+tmdCertLen], certSet.TMD.Raw) {
+		return nil, fmt.Errorf("cia: invalid TMD certificate")
+	}
+
+	return certSet, nil
+}
+
+// checkContent verifies a content whose raw data is read from the given reader.
+//
+// The structure and the offset locate the content in its container, and are used to report
+// errors. The returned error describes the first problem found in this content. In any case, the
+// caller is responsible for consuming the rest of the content.
+func checkContent(input *ctrutil.Reader, content *TMDContent, titleKey []byte, titleID Hex64, structure string, offset int64, options *Options) (*CIAContentNCCH, *SMDH, error) {
+	if options.SkipContentHashes && options.SkipNCCH {
+		return nil, nil, nil
+	}
+
+	size := int64(content.Size)
+	var data io.Reader = input
+
+	if content.Encrypted {
+		contentCipher, err := aes.NewCipher(titleKey)
 		if err != nil {
-			return nil, fmt.Errorf("cia: failed to read content %s: %w", content.ID, err)
+			return nil, nil, fmt.Errorf("%s: failed to initialize AES cipher for content %s: %w", structure, content.ID, err)
+		}
+		if size%int64(contentCipher.BlockSize()) != 0 {
+			return nil, nil, fmt.Errorf("%s: length of content %s must be a multiple of the AES block size: %d %% %d != 0", structure, content.ID, size, contentCipher.BlockSize())
 		}
+		contentIV := make([]byte, contentCipher.BlockSize())
+		binary.BigEndian.PutUint16(contentIV, uint16(content.Index))
+		data = cipherio.NewBlockReader(data, cipher.NewCBCDecrypter(contentCipher, contentIV))
+	}
+
+	hash := sha256.New()
+	if !options.SkipContentHashes {
+		data = io.TeeReader(data, hash)
+	}
+
+	dataReader := ctrutil.NewReader(data)
 
-		if !bytes.Equal(hash.Sum(nil), content.Hash) {
-			return nil, fmt.Errorf("cia: invalid hash for content %s", content.ID)
+	var contentNCCH *CIAContentNCCH
+	var icon *SMDH
+	var ncchErr error
+
+	if !options.SkipNCCH {
+		ncch, err := CheckNCCHWithOptions(dataReader, size, options)
+		if err != nil {
+			ncchErr = fmt.Errorf("%s: invalid content %s: %w", structure, content.ID, err)
+		} else {
+			contentNCCH = &CIAContentNCCH{
+				Legit:      ncch.Legit,
+				Encrypted:  ncch.Encrypted,
+				ExHeader:   ncch.ExHeader,
+				Unverified: ncch.Unverified,
+			}
+
+			if ncch.ExeFS != nil {
+				icon = ncch.ExeFS.Icon
+			}
+
+			if ncch.ProgramID != titleID {
+				ncchErr = fmt.Errorf("%s: content %s has unexpected program ID: %s != %s", structure, content.ID, ncch.ProgramID, titleID)
+			}
+		}
+
+		if ncchErr != nil && options.SkipContentHashes {
+			return contentNCCH, icon, ncchErr
 		}
 	}
 
-	meta := metaLen > 0
-	if meta {
-		if metaLen != 0x3ac0 {
-			return nil, fmt.Errorf("cia: when present, meta must have length %d, got %d", 0x3ac0, metaLen)
+	_, err := io.Copy(ioutil.Discard, dataReader)
+	if err == nil && dataReader.Offset() < size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return contentNCCH, icon, fmt.Errorf("%s: failed to read content %s: %w", structure, content.ID, err)
+	}
+
+	if ncchErr != nil {
+		return contentNCCH, icon, ncchErr
+	}
+
+	if !options.SkipContentHashes && !bytes.Equal(hash.Sum(nil), content.Hash) {
+		return contentNCCH, icon, &HashMismatchError{
+			Location: contentLocation(structure, content, offset),
+			Subject:  fmt.Sprintf("content %s", content.ID),
 		}
+	}
 
-		err = reader.Discard((0x40 - (reader.Offset() % 0x40)) % 0x40)
+	return contentNCCH, icon, nil
+}
+
+// checkCIAMeta verifies the meta section embedded in a CIA file, given the icon found in the
+// ExeFS of the first content.
+func checkCIAMeta(reader *ctrutil.Reader, icon *SMDH, options *Options, findings *findings) (*CIAMeta, error) {
+	metaOffset := reader.Offset()
+
+	rawMeta := make([]byte, 0x400)
+	_, err := io.ReadFull(reader, rawMeta)
+	if err != nil {
+		return nil, fmt.Errorf("cia: failed to read meta: %w", err)
+	}
+
+	dependencies := make([]Hex64, 0)
+	for i := 0; i < 0x30; i++ {
+		dependency := binary.LittleEndian.Uint64(rawMeta[i*0x8:])
+		if dependency != 0 {
+			dependencies = append(dependencies, Hex64(dependency))
+		}
+	}
+
+	coreVersion := binary.LittleEndian.Uint32(rawMeta[0x300:])
+
+	meta := &CIAMeta{
+		Dependencies: dependencies,
+		CoreVersion:  coreVersion,
+	}
+
+	iconOffset := reader.Offset()
+	data := ctrutil.NewReader(io.LimitReader(reader, 0x36c0))
+
+	if !options.SkipSMDH {
+		meta.Icon, err = ParseSMDH(data)
 		if err != nil {
-			return nil, fmt.Errorf("cia: failed to skip contents padding: %w", err)
+			err = findings.problem("meta", iconOffset, fmt.Errorf("cia: invalid meta icon: %w", err))
+			if err != nil {
+				return meta, err
+			}
 		}
+	}
+
+	err = data.Discard(0x36c0 - data.Offset())
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return meta, fmt.Errorf("cia: failed to read meta icon: %w", err)
+	}
 
-		err = reader.Discard(int64(metaLen))
+	if icon != nil && meta.Icon != nil && !bytes.Equal(icon.raw, meta.Icon.raw) {
+		err = findings.problem("meta", metaOffset, fmt.Errorf("cia: meta icon does not match ExeFS icon"))
 		if err != nil {
-			return nil, fmt.Errorf("cia: failed to read meta")
-		}
-	}
-
-	err = reader.Discard(1)
-	if err == nil {
-		return nil, fmt.Errorf("cia: extraneous data after %d bytes", reader.Offset()-1)
-	} else if err != io.EOF {
-		return nil, fmt.Errorf("cia: failed to check extraneous data: %w", err)
-	}
-
-	return &CIA{
-		Legit:    legit,
-		Complete: complete,
-		TitleID:  titleID,
-		Ticket: CIATicket{
-			Legit:     ticket.Legit,
-			TicketID:  ticket.TicketID,
-			ConsoleID: ticket.ConsoleID,
-			TitleKey:  ticket.TitleKey,
-		},
-		TMD: CIATMD{
-			Legit:        tmd.Legit,
-			Original:     tmd.Original,
-			TitleVersion: tmd.TitleVersion,
-		},
-		Contents: contents,
-		Icon:     icon,
-		Meta:     meta,
-	}, nil
+			return meta, err
+		}
+	}
+
+	return meta, nil
 }
@@ -0,0 +1,100 @@
+package ctrsigcheck
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// DecryptCIA writes a decrypted copy of the given CIA file.
+//
+// The title key encryption is removed from each content, and the encrypted bits are cleared from
+// the TMD. NCCH contents are further decrypted as DecryptNCCH does. The TMD keeps its signature
+// and the original content hashes, so that the original TMD can still be recognized (see
+// TMD.Original). As a consequence, the hashes of decrypted NCCH contents no longer match.
+//
+// The CIA file is only parsed as far as OpenCIA does. Use CheckCIA beforehand to verify it.
+func DecryptCIA(r io.ReaderAt, size int64, w io.Writer) error {
+	cia, err := OpenCIA(r, size)
+	if err != nil {
+		return err
+	}
+
+	tmd := rewriteTMDContentTypes(cia.TMD.raw, func(content *TMDContent) Hex16 {
+		return content.Type &^ 0x0001
+	})
+
+	return rewriteCIA(cia, w, tmd, func(index int, w io.Writer) error {
+		data, err := cia.DecryptedContentReader(index)
+		if err != nil {
+			return err
+		}
+
+		if !isNCCH(data) {
+			_, err = io.Copy(w, data)
+			return err
+		}
+
+		err = DecryptNCCH(data, data.Size(), w)
+		if err != nil {
+			return fmt.Errorf("cia: failed to decrypt content %s: %w", cia.Contents[index].ID, err)
+		}
+		return nil
+	})
+}
+
+// isNCCH tells whether the given content starts with an NCCH header.
+func isNCCH(data io.ReaderAt) bool {
+	magic := make([]byte, 0x4)
+	_, err := data.ReadAt(magic, 0x100)
+	return err == nil && string(magic) == "NCCH"
+}
+
+// rewriteCIA writes a copy of the CIA file with the given TMD, and each present content written
+// by writeContent. Other sections are copied as is.
+func rewriteCIA(cia *CIAReader, w io.Writer, tmd []byte, writeContent func(index int, w io.Writer) error) error {
+	if int64(len(tmd)) > cia.tmd.Size() {
+		return fmt.Errorf("cia: TMD exceeds its section")
+	}
+
+	copySection := func(start, end int64) error {
+		_, err := io.Copy(w, io.NewSectionReader(cia.r, start, end-start))
+		if err != nil {
+			return fmt.Errorf("cia: failed to write: %w", err)
+		}
+		return nil
+	}
+
+	err := copySection(0, cia.tmdOffset)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(tmd)
+	if err != nil {
+		return fmt.Errorf("cia: failed to write: %w", err)
+	}
+
+	err = copySection(cia.tmdOffset+int64(len(tmd)), cia.contentsStart)
+	if err != nil {
+		return err
+	}
+
+	for index, content := range cia.Contents {
+		if content.Missing {
+			continue
+		}
+
+		writer := ctrutil.NewWriter(w)
+		err = writeContent(index, writer)
+		if err != nil {
+			return err
+		}
+		if writer.Offset() != int64(content.Size) {
+			return fmt.Errorf("cia: content %s changed size: %d != %d", content.ID, writer.Offset(), content.Size)
+		}
+	}
+
+	return copySection(cia.contentsEnd, cia.size)
+}
@@ -0,0 +1,261 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/connesc/cipherio"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// EncryptOptions adjust the behavior of EncryptCIA.
+type EncryptOptions struct {
+	// NCCHCrypto lists the candidate encryptions of decrypted NCCH contents. For each content, the
+	// first one that restores the original hash is selected, and those whose keys are missing
+	// are skipped. If empty, the standard encryptions (each crypto method whose KeyX is known,
+	// also with seed crypto if the seed of the title is known and matches the header), a fixed
+	// key encryption and no encryption at all are tried in this order.
+	NCCHCrypto []NCCHCrypto
+}
+
+// defaultNCCHCrypto returns the candidate encryptions of a decrypted NCCH with the given header,
+// when none are given in EncryptOptions.
+func defaultNCCHCrypto(header []byte) []NCCHCrypto {
+	_, err := ncchSeedKeyY(header)
+	seed := err == nil
+
+	candidates := make([]NCCHCrypto, 0)
+	for _, method := range []struct {
+		method uint8
+		keyX   []byte
+	}{
+		{0x00, ncchKeyX},
+		{0x01, Keys.KeyX25},
+		{0x0a, Keys.KeyX18},
+		{0x0b, Keys.KeyX1B},
+	} {
+		if method.keyX == nil {
+			continue
+		}
+		candidates = append(candidates, NCCHCrypto{Method: method.method})
+		if seed {
+			candidates = append(candidates, NCCHCrypto{Method: method.method, Seed: true})
+		}
+	}
+	return append(candidates, NCCHCrypto{FixedKey: true}, NCCHCrypto{NoCrypto: true})
+}
+
+// EncryptCIA writes an encrypted copy of the given decrypted CIA file.
+//
+// This is the inverse of DecryptCIA. Decrypted NCCH contents are encrypted again, and the title
+// key encryption is applied to each content. If the TMD has been modified on decryption (see
+// TMD.Original), its original form is restored. Otherwise, every content is marked as encrypted.
+//
+// Each content must match its hash in the TMD once encrypted, otherwise a HashMismatchError is
+// returned. When the original TMD and the ticket are legit, the result is thus legit too.
+func EncryptCIA(r io.ReaderAt, size int64, w io.Writer, options *EncryptOptions) error {
+	if options == nil {
+		options = &EncryptOptions{}
+	}
+	cia, err := OpenCIA(r, size)
+	if err != nil {
+		return err
+	}
+
+	tmd := cia.TMD.originalRaw()
+	if tmd == nil {
+		tmd = rewriteTMDContentTypes(cia.TMD.raw, func(content *TMDContent) Hex16 {
+			return content.Type | 0x0001
+		})
+	}
+
+	return rewriteCIA(cia, w, tmd, func(index int, w io.Writer) error {
+		content := &cia.Contents[index]
+		data, err := cia.DecryptedContentReader(index)
+		if err != nil {
+			return err
+		}
+
+		encryptedData := func(crypto NCCHCrypto) (io.Reader, error) {
+			return io.NewSectionReader(data, 0, data.Size()), nil
+		}
+		encryptedWriter := func(crypto NCCHCrypto, w io.Writer) (io.Writer, error) {
+			return w, nil
+		}
+		contentCandidates := []NCCHCrypto{{NoCrypto: true}}
+		if isDecryptedNCCH(data) {
+			encryptedData = func(crypto NCCHCrypto) (io.Reader, error) {
+				return encryptedNCCHReader(data, data.Size(), crypto)
+			}
+			encryptedWriter = func(crypto NCCHCrypto, w io.Writer) (io.Writer, error) {
+				header, regions, err := encryptedNCCHRegions(data, data.Size(), crypto)
+				if err != nil || header == nil {
+					return w, err
+				}
+				return newNCCHWriter(w, header, regions), nil
+			}
+			contentCandidates = options.NCCHCrypto
+			if len(contentCandidates) == 0 {
+				header := make([]byte, 0x200)
+				_, err = data.ReadAt(header, 0)
+				if err != nil {
+					return fmt.Errorf("cia: failed to read content %s: %w", content.ID, err)
+				}
+				contentCandidates = defaultNCCHCrypto(header)
+			}
+		}
+
+		// Candidates whose keys are missing are skipped. The original encryption may be one of
+		// them, which is reported if no other candidate matches.
+		var missingKey *MissingKeyError
+		mismatch := func() error {
+			if missingKey != nil {
+				return missingKey
+			}
+			return &HashMismatchError{
+				Location: contentLocation("cia", &content.TMDContent, cia.contentOffset[index]),
+				Subject:  fmt.Sprintf("content %s", content.ID),
+			}
+		}
+
+		candidates := make([]NCCHCrypto, 0, len(contentCandidates))
+		hashes := make([]hash.Hash, 0, len(contentCandidates))
+		writers := make([]io.Writer, 0, len(contentCandidates))
+		for _, crypto := range contentCandidates {
+			hasher := sha256.New()
+			writer, err := encryptedWriter(crypto, hasher)
+			if errors.As(err, &missingKey) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("cia: failed to encrypt content %s: %w", content.ID, err)
+			}
+			candidates = append(candidates, crypto)
+			hashes = append(hashes, hasher)
+			writers = append(writers, writer)
+		}
+		if len(candidates) == 0 {
+			return mismatch()
+		}
+
+		// The content is read once to hash every candidate, then once more to write the selected
+		// one. A single candidate is directly written, and its hash is checked afterwards.
+		selected := candidates[0]
+		var check hash.Hash
+		if len(candidates) > 1 {
+			_, err = io.Copy(io.MultiWriter(writers...), io.NewSectionReader(data, 0, data.Size()))
+			if err != nil {
+				return fmt.Errorf("cia: failed to read content %s: %w", content.ID, err)
+			}
+			found := false
+			for i, hasher := range hashes {
+				if bytes.Equal(hasher.Sum(nil), content.Hash) {
+					selected, found = candidates[i], true
+					break
+				}
+			}
+			if !found {
+				return mismatch()
+			}
+		} else {
+			check = sha256.New()
+		}
+
+		reader, err := encryptedData(selected)
+		if err != nil {
+			return fmt.Errorf("cia: failed to encrypt content %s: %w", content.ID, err)
+		}
+		if check != nil {
+			reader = io.TeeReader(reader, check)
+		}
+
+		// Only contents that are unencrypted in the original TMD are left as is.
+		if !cia.TMD.Original || content.Encrypted {
+			contentCipher, err := aes.NewCipher(cia.Ticket.TitleKey.Decrypted)
+			if err != nil {
+				return fmt.Errorf("cia: failed to initialize AES cipher for content %s: %w", content.ID, err)
+			}
+			if data.Size()%int64(contentCipher.BlockSize()) != 0 {
+				return fmt.Errorf("cia: length of content %s must be a multiple of the AES block size: %d %% %d != 0", content.ID, data.Size(), contentCipher.BlockSize())
+			}
+			contentIV := make([]byte, contentCipher.BlockSize())
+			binary.BigEndian.PutUint16(contentIV, uint16(content.Index))
+			reader = cipherio.NewBlockReader(reader, cipher.NewCBCEncrypter(contentCipher, contentIV))
+		}
+
+		_, err = io.Copy(w, reader)
+		if err != nil {
+			return err
+		}
+		if check != nil && !bytes.Equal(check.Sum(nil), content.Hash) {
+			return mismatch()
+		}
+		return nil
+	})
+}
+
+// isDecryptedNCCH tells whether the given content is an NCCH with the NoCrypto flag.
+func isDecryptedNCCH(data io.ReaderAt) bool {
+	flags := make([]byte, 0x8)
+	_, err := data.ReadAt(flags, 0x188)
+	return err == nil && isNCCH(data) && flags[7]&ncchNoCrypto != 0
+}
+
+// RestoreCIATMD replaces the TMD of the given CIA file by its original form, as RestoreTMD does.
+//
+// The file is only modified if each present content matches its hash according to the original
+// TMD, which means that contents must still be encrypted with the title key. Otherwise, a
+// HashMismatchError is returned and EncryptCIA should be used instead.
+func RestoreCIATMD(f interface {
+	io.ReaderAt
+	io.WriterAt
+}, size int64) error {
+	cia, err := OpenCIA(f, size)
+	if err != nil {
+		return err
+	}
+
+	if cia.TMD.Original {
+		return nil
+	}
+
+	original := cia.TMD.originalRaw()
+	if original == nil {
+		return fmt.Errorf("tmd: original form not recognized")
+	}
+
+	tmd, err := CheckTMD(bytes.NewReader(original))
+	if err != nil {
+		return err
+	}
+
+	for index, content := range cia.Contents {
+		if content.Missing {
+			continue
+		}
+
+		data, err := cia.ContentReader(index)
+		if err != nil {
+			return err
+		}
+
+		_, _, err = checkContent(ctrutil.NewReader(data), &tmd.Contents[index], cia.Ticket.TitleKey.Decrypted, tmd.TitleID, "cia", cia.contentOffset[index], &Options{SkipNCCH: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = f.WriteAt(original, cia.tmdOffset)
+	if err != nil {
+		return fmt.Errorf("cia: failed to write TMD: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package ctrsigcheck
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// CIAReader gives random access to the sections of a CIA file.
+//
+// Unlike CheckCIA, only the information needed to locate each section is parsed and verified.
+type CIAReader struct {
+	Ticket   *Ticket
+	TMD      *TMD
+	Contents []CIAContent
+
+	certs         *io.SectionReader
+	ticket        *io.SectionReader
+	tmd           *io.SectionReader
+	meta          *io.SectionReader
+	contentOffset []int64
+	r             io.ReaderAt
+	size          int64
+	tmdOffset     int64
+	contentsStart int64
+	contentsEnd   int64
+}
+
+func alignCIA(offset int64) int64 {
+	return offset + (0x40-offset%0x40)%0x40
+}
+
+// OpenCIA reads the header, the ticket and the TMD of the given CIA file in order to compute the
+// offset of each section.
+func OpenCIA(r io.ReaderAt, size int64) (*CIAReader, error) {
+	header := make([]byte, 0x2020)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cia: failed to read header: %w", err)
+	}
+
+	headerLen := binary.LittleEndian.Uint32(header)
+	if headerLen != 0x2020 {
+		return nil, fmt.Errorf("cia: header length must be %d, got %d", 0x2020, headerLen)
+	}
+
+	certsLen := int64(binary.LittleEndian.Uint32(header[0x8:]))
+	ticketLen := int64(binary.LittleEndian.Uint32(header[0xc:]))
+	tmdLen := int64(binary.LittleEndian.Uint32(header[0x10:]))
+	metaLen := int64(binary.LittleEndian.Uint32(header[0x14:]))
+	contentLen := binary.LittleEndian.Uint64(header[0x18:])
+	contentIndex := header[0x20:]
+
+	certsOffset := alignCIA(int64(headerLen))
+	ticketOffset := alignCIA(certsOffset + certsLen)
+	tmdOffset := alignCIA(ticketOffset + ticketLen)
+	contentOffset := alignCIA(tmdOffset + tmdLen)
+
+	if contentLen >= 1<<62 || contentOffset+int64(contentLen) > size {
+		return nil, fmt.Errorf("cia: total size of contents exceeds file size: %d > %d", contentLen, size-contentOffset)
+	}
+
+	metaOffset := alignCIA(contentOffset + int64(contentLen))
+	if metaLen > 0 && metaOffset+metaLen > size {
+		return nil, fmt.Errorf("cia: meta exceeds file size")
+	}
+
+	ticket, err := CheckTicket(io.NewSectionReader(r, ticketOffset, ticketLen))
+	if err != nil {
+		return nil, err
+	}
+
+	tmd, err := CheckTMD(io.NewSectionReader(r, tmdOffset, tmdLen))
+	if err != nil {
+		return nil, err
+	}
+
+	contents := make([]CIAContent, len(tmd.Contents))
+	offsets := make([]int64, len(tmd.Contents))
+	offset := contentOffset
+	for index, content := range tmd.Contents {
+		missing := contentIndex[content.Index/8]&(1<<(7-(content.Index%8))) == 0
+		if !missing {
+			if content.Size > uint64(contentOffset+int64(contentLen)-offset) {
+				return nil, fmt.Errorf("cia: content %s exceeds total size of contents", content.ID)
+			}
+			offsets[index] = offset
+			offset += int64(content.Size)
+		}
+		contents[index] = CIAContent{
+			Missing:    missing,
+			TMDContent: content,
+		}
+	}
+
+	if offset != contentOffset+int64(contentLen) {
+		return nil, fmt.Errorf("cia: total size of contents does not match expected value: %d != %d", offset-contentOffset, contentLen)
+	}
+
+	var meta *io.SectionReader
+	if metaLen > 0 {
+		meta = io.NewSectionReader(r, metaOffset, metaLen)
+	}
+
+	return &CIAReader{
+		Ticket:        ticket,
+		TMD:           tmd,
+		Contents:      contents,
+		certs:         io.NewSectionReader(r, certsOffset, certsLen),
+		ticket:        io.NewSectionReader(r, ticketOffset, ticketLen),
+		tmd:           io.NewSectionReader(r, tmdOffset, tmdLen),
+		meta:          meta,
+		contentOffset: offsets,
+		r:             r,
+		size:          size,
+		tmdOffset:     tmdOffset,
+		contentsStart: contentOffset,
+		contentsEnd:   offset,
+	}, nil
+}
+
+// CertsReader returns the certificate chain section.
+func (c *CIAReader) CertsReader() *io.SectionReader {
+	return io.NewSectionReader(c.certs, 0, c.certs.Size())
+}
+
+// TicketReader returns the ticket section.
+func (c *CIAReader) TicketReader() *io.SectionReader {
+	return io.NewSectionReader(c.ticket, 0, c.ticket.Size())
+}
+
+// TMDReader returns the TMD section.
+func (c *CIAReader) TMDReader() *io.SectionReader {
+	return io.NewSectionReader(c.tmd, 0, c.tmd.Size())
+}
+
+// MetaReader returns the meta section, or nil if there is none.
+func (c *CIAReader) MetaReader() *io.SectionReader {
+	if c.meta == nil {
+		return nil
+	}
+	return io.NewSectionReader(c.meta, 0, c.meta.Size())
+}
+
+// ContentReader returns the raw content section at the given position in Contents.
+//
+// Encrypted contents are returned as is. Use DecryptedContentReader to remove the title key
+// encryption.
+func (c *CIAReader) ContentReader(index int) (*io.SectionReader, error) {
+	if index < 0 || index >= len(c.Contents) {
+		return nil, fmt.Errorf("cia: content position out of range: %d", index)
+	}
+
+	content := &c.Contents[index]
+	if content.Missing {
+		return nil, fmt.Errorf("cia: content %s is missing", content.ID)
+	}
+
+	return io.NewSectionReader(c.r, c.contentOffset[index], int64(content.Size)), nil
+}
+
+// DecryptedContentReader returns the content section at the given position in Contents, after
+// removing the title key encryption if needed.
+func (c *CIAReader) DecryptedContentReader(index int) (*io.SectionReader, error) {
+	data, err := c.ContentReader(index)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &c.Contents[index]
+	if !content.Encrypted {
+		return data, nil
+	}
+
+	contentCipher, err := aes.NewCipher(c.Ticket.TitleKey.Decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("cia: failed to initialize AES cipher for content %s: %w", content.ID, err)
+	}
+	if data.Size()%int64(contentCipher.BlockSize()) != 0 {
+		return nil, fmt.Errorf("cia: length of content %s must be a multiple of the AES block size: %d %% %d != 0", content.ID, data.Size(), contentCipher.BlockSize())
+	}
+	contentIV := make([]byte, contentCipher.BlockSize())
+	binary.BigEndian.PutUint16(contentIV, uint16(content.Index))
+
+	return io.NewSectionReader(ctrutil.NewCBCDecrypterAt(data, contentCipher, contentIV), 0, data.Size()), nil
+}
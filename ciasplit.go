@@ -0,0 +1,95 @@
+package ctrsigcheck
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SplitCIA writes the sections of the given CIA file into a directory, using the layout of
+// Nintendo's CDN.
+//
+// The ticket and the TMD are written as "cetk" and "tmd", followed by the certificates of their
+// environment, so that the result is accepted by CheckCDN. Each present content is written as is,
+// still encrypted, in a file named after its ID in 8 lowercase hexadecimal digits. If the CIA file
+// has a meta section, its icon is written as "meta.smdh".
+//
+// The CIA file is only parsed as far as OpenCIA does. Use CheckCIA beforehand to verify it.
+func SplitCIA(r io.ReaderAt, size int64, dir string) error {
+	cia, err := OpenCIA(r, size)
+	if err != nil {
+		return err
+	}
+
+	certs := findCertificateSet(cia.Ticket.Environment)
+	err = writeCDNFile(filepath.Join(dir, "cetk"), cia.Ticket.raw, certs.Ticket.Raw, certs.CA.Raw)
+	if err != nil {
+		return err
+	}
+
+	certs = findCertificateSet(cia.TMD.Environment)
+	err = writeCDNFile(filepath.Join(dir, "tmd"), cia.TMD.raw, certs.TMD.Raw, certs.CA.Raw)
+	if err != nil {
+		return err
+	}
+
+	for index, content := range cia.Contents {
+		if content.Missing {
+			continue
+		}
+
+		data, err := cia.ContentReader(index)
+		if err != nil {
+			return err
+		}
+
+		err = copyCDNFile(filepath.Join(dir, fmt.Sprintf("%08x", uint32(content.ID))), data)
+		if err != nil {
+			return err
+		}
+	}
+
+	if meta := cia.MetaReader(); meta != nil {
+		if meta.Size() != 0x3ac0 {
+			return fmt.Errorf("cia: when present, meta must have length %d, got %d", 0x3ac0, meta.Size())
+		}
+
+		err = copyCDNFile(filepath.Join(dir, "meta.smdh"), io.NewSectionReader(meta, 0x400, 0x36c0))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeCDNFile(path string, parts ...[]byte) error {
+	data := make([]byte, 0)
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+
+	err := ioutil.WriteFile(path, data, 0666)
+	if err != nil {
+		return fmt.Errorf("cia: failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+func copyCDNFile(path string, input io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("cia: failed to write %s: %w", filepath.Base(path), err)
+	}
+
+	_, err = io.Copy(file, input)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("cia: failed to write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
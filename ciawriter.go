@@ -0,0 +1,256 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/connesc/cipherio"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// CIAWriterOptions adjust the CIA file produced by a CIAWriter.
+type CIAWriterOptions struct {
+	// OmitContents lists the IDs of the optional contents that won't be written.
+	OmitContents []Hex32
+
+	// Meta enables the generation of a meta section, based on the icon and the ExHeader of the
+	// first content. This content, with index 0, must not be omitted.
+	Meta bool
+}
+
+// CIAWriter assembles a CIA file from a ticket, a TMD and the content streams.
+//
+// The header, the certificate chain, the ticket and the TMD are written by NewCIAWriter. Then,
+// WriteContent must be called for each content present in the CIA file, in TMD order. Finally,
+// Close writes the meta section, if any.
+type CIAWriter struct {
+	writer   *ctrutil.Writer
+	ticket   *Ticket
+	tmd      *TMD
+	omitted  map[Hex32]bool
+	meta     bool
+	next     int
+	icon     *SMDH
+	exheader *ExHeader
+	closed   bool
+}
+
+// NewCIAWriter writes the beginning of a CIA file, up to the first content.
+//
+// The given ticket and TMD are parsed with CheckTicket and CheckTMD. They may be followed by a
+// certificate chain, as found in files downloaded from Nintendo's CDN. The certificate chain
+// written to the CIA file is the one that matches the environment of the ticket.
+func NewCIAWriter(w io.Writer, ticket, tmd []byte, options *CIAWriterOptions) (*CIAWriter, error) {
+	if options == nil {
+		options = &CIAWriterOptions{}
+	}
+
+	parsedTicket, err := CheckTicket(bytes.NewReader(ticket))
+	if err != nil {
+		return nil, err
+	}
+
+	parsedTMD, err := CheckTMD(bytes.NewReader(tmd))
+	if err != nil {
+		return nil, err
+	}
+
+	if parsedTicket.TitleID != parsedTMD.TitleID {
+		return nil, fmt.Errorf("cia: ticket and TMD have different title IDs: %s != %s", parsedTicket.TitleID, parsedTMD.TitleID)
+	}
+
+	if parsedTicket.Environment != parsedTMD.Environment {
+		return nil, fmt.Errorf("cia: ticket and TMD have different environments: %s != %s", parsedTicket.Environment, parsedTMD.Environment)
+	}
+
+	certs := findCertificateSet(parsedTicket.Environment)
+
+	omitted := make(map[Hex32]bool)
+	for _, id := range options.OmitContents {
+		omitted[id] = true
+	}
+
+	header := make([]byte, 0x2020)
+	contentIndex := header[0x20:]
+	contentLen := uint64(0)
+	for _, content := range parsedTMD.Contents {
+		if omitted[content.ID] {
+			if !content.Optional {
+				return nil, fmt.Errorf("cia: required content %s cannot be omitted", content.ID)
+			}
+			continue
+		}
+		contentIndex[content.Index/8] |= 1 << (7 - content.Index%8)
+		contentLen += content.Size
+	}
+
+	if options.Meta && contentIndex[0]&0x80 == 0 {
+		return nil, fmt.Errorf("cia: meta requires a content with index 0")
+	}
+
+	chain := certs.Chain()
+	binary.LittleEndian.PutUint32(header, 0x2020)
+	binary.LittleEndian.PutUint32(header[0x8:], uint32(len(chain)))
+	binary.LittleEndian.PutUint32(header[0xc:], uint32(len(parsedTicket.raw)))
+	binary.LittleEndian.PutUint32(header[0x10:], uint32(len(parsedTMD.raw)))
+	if options.Meta {
+		binary.LittleEndian.PutUint32(header[0x14:], 0x3ac0)
+	}
+	binary.LittleEndian.PutUint64(header[0x18:], contentLen)
+
+	writer := ctrutil.NewWriter(w)
+	for _, section := range [][]byte{header, chain, parsedTicket.raw, parsedTMD.raw} {
+		_, err = writer.Write(section)
+		if err == nil {
+			err = writer.Align(0x40)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cia: failed to write: %w", err)
+		}
+	}
+
+	return &CIAWriter{
+		writer:  writer,
+		ticket:  parsedTicket,
+		tmd:     parsedTMD,
+		omitted: omitted,
+		meta:    options.Meta,
+	}, nil
+}
+
+// NextContent returns the content expected by the next call to WriteContent, or nil if all
+// contents have been written.
+func (cw *CIAWriter) NextContent() *TMDContent {
+	for cw.next < len(cw.tmd.Contents) && cw.omitted[cw.tmd.Contents[cw.next].ID] {
+		cw.next++
+	}
+	if cw.next >= len(cw.tmd.Contents) {
+		return nil
+	}
+	return &cw.tmd.Contents[cw.next]
+}
+
+// WriteContent writes the next content, as returned by NextContent.
+//
+// Exactly as many bytes as specified by the TMD are read from the given input. Encrypted contents
+// must be given encrypted with the title key, as they would be stored in a CIA file.
+func (cw *CIAWriter) WriteContent(input io.Reader) error {
+	content := cw.NextContent()
+	if content == nil {
+		return fmt.Errorf("cia: no more contents expected")
+	}
+	cw.next++
+
+	if content.Size >= 1<<63 {
+		return fmt.Errorf("cia: size of content %s too large: %d", content.ID, content.Size)
+	}
+	size := int64(content.Size)
+
+	if !cw.meta || content.Index != 0x0000 {
+		_, err := io.CopyN(cw.writer, input, size)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("cia: failed to write content %s: %w", content.ID, err)
+		}
+		return nil
+	}
+
+	// The icon and the ExHeader of the first content are extracted while it is being written.
+	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := cw.readMeta(pipeReader, content)
+		io.Copy(ioutil.Discard, pipeReader)
+		done <- err
+	}()
+
+	_, err := io.CopyN(io.MultiWriter(cw.writer, pipeWriter), input, size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	pipeWriter.CloseWithError(err)
+	metaErr := <-done
+
+	if err != nil {
+		return fmt.Errorf("cia: failed to write content %s: %w", content.ID, err)
+	}
+	if metaErr != nil {
+		return fmt.Errorf("cia: failed to extract meta from content %s: %w", content.ID, metaErr)
+	}
+	return nil
+}
+
+func (cw *CIAWriter) readMeta(input io.Reader, content *TMDContent) error {
+	data := input
+	if content.Encrypted {
+		contentCipher, err := aes.NewCipher(cw.ticket.TitleKey.Decrypted)
+		if err != nil {
+			return err
+		}
+		contentIV := make([]byte, contentCipher.BlockSize())
+		binary.BigEndian.PutUint16(contentIV, uint16(content.Index))
+		data = cipherio.NewBlockReader(data, cipher.NewCBCDecrypter(contentCipher, contentIV))
+	}
+
+	ncch, err := ParseNCCH(data)
+	if err != nil {
+		return err
+	}
+	if ncch.ExeFS == nil || ncch.ExeFS.Icon == nil {
+		return fmt.Errorf("icon not found")
+	}
+
+	cw.icon = ncch.ExeFS.Icon
+	cw.exheader = ncch.ExHeader
+	return nil
+}
+
+// Close checks that all contents have been written, and writes the meta section if needed.
+//
+// The underlying writer is not closed.
+func (cw *CIAWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+
+	if content := cw.NextContent(); content != nil {
+		return fmt.Errorf("cia: content %s has not been written", content.ID)
+	}
+
+	if !cw.meta {
+		return nil
+	}
+	if cw.icon == nil {
+		return fmt.Errorf("cia: cannot write meta without the icon of the first content")
+	}
+
+	meta := make([]byte, 0x400)
+	if cw.exheader != nil {
+		for i, dependency := range cw.exheader.SCI.Dependencies {
+			binary.LittleEndian.PutUint64(meta[i*0x8:], uint64(dependency))
+		}
+		binary.LittleEndian.PutUint32(meta[0x300:], cw.exheader.ACI.ARM11LocalCaps.CoreVersion)
+	}
+
+	err := cw.writer.Align(0x40)
+	if err == nil {
+		_, err = cw.writer.Write(meta)
+	}
+	if err == nil {
+		_, err = cw.writer.Write(cw.icon.raw)
+	}
+	if err != nil {
+		return fmt.Errorf("cia: failed to write meta: %w", err)
+	}
+
+	return nil
+}
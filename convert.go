@@ -0,0 +1,341 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// Conversion describes the result of a conversion between CCI and CIA files.
+type Conversion struct {
+	// NotLegit lists the parts of the converted file whose signature could not be preserved.
+	NotLegit []string
+}
+
+// ticketContentIndex is the content index of tickets that give access to every content.
+var ticketContentIndex = []byte{
+	0x00, 0x01, 0x00, 0x14, 0x00, 0x00, 0x00, 0xac, 0x00, 0x00, 0x00, 0x14, 0x00, 0x01, 0x00, 0x14,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x84,
+	0x00, 0x00, 0x00, 0x84, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// newUnsignedTicket builds a ticket for the given title, with an empty signature.
+func newUnsignedTicket(certs *CertificateSet, titleID Hex64, titleVersion uint16) []byte {
+	signatureType := RSA2048SHA256
+	ticket := make([]byte, signatureType.sectionLen()+0x210)
+	binary.BigEndian.PutUint32(ticket, uint32(signatureType))
+
+	data := ticket[signatureType.sectionLen():]
+	copy(data, certs.TicketIssuer())
+	data[0x7c] = 1
+	binary.BigEndian.PutUint64(data[0x9c:], uint64(titleID))
+	binary.BigEndian.PutUint16(data[0xa6:], titleVersion)
+	copy(data[0x164:], ticketContentIndex)
+	for i := 0x164 + len(ticketContentIndex); i < len(data); i++ {
+		data[i] = 0xff
+	}
+
+	return ticket
+}
+
+// newUnsignedTMD builds a TMD for the given title and contents, with an empty signature.
+func newUnsignedTMD(certs *CertificateSet, titleID Hex64, titleVersion uint16, contents []TMDContent) []byte {
+	signatureType := RSA2048SHA256
+	signatureLen := signatureType.sectionLen()
+	tmd := make([]byte, signatureLen+0x9c4+0x30*len(contents))
+	binary.BigEndian.PutUint32(tmd, uint32(signatureType))
+
+	header := tmd[signatureLen : signatureLen+0xc4]
+	contentInfoRecords := tmd[signatureLen+0xc4 : signatureLen+0x9c4]
+	contentChunkRecords := tmd[signatureLen+0x9c4:]
+
+	copy(header, certs.TMDIssuer())
+	header[0x40] = 1
+	binary.BigEndian.PutUint64(header[0x4c:], uint64(titleID))
+	binary.BigEndian.PutUint32(header[0x54:], 0x40)
+	binary.BigEndian.PutUint16(header[0x9c:], titleVersion)
+	binary.BigEndian.PutUint16(header[0x9e:], uint16(len(contents)))
+
+	for i, content := range contents {
+		chunkRecord := contentChunkRecords[i*0x30 : (i+1)*0x30]
+		binary.BigEndian.PutUint32(chunkRecord, uint32(content.ID))
+		binary.BigEndian.PutUint16(chunkRecord[0x4:], uint16(content.Index))
+		binary.BigEndian.PutUint16(chunkRecord[0x6:], uint16(content.Type))
+		binary.BigEndian.PutUint64(chunkRecord[0x8:], content.Size)
+		copy(chunkRecord[0x10:], content.Hash)
+	}
+
+	binary.BigEndian.PutUint16(contentInfoRecords[0x2:], uint16(len(contents)))
+	copy(contentInfoRecords[0x4:0x24], sha256Hash(contentChunkRecords))
+	copy(header[0xa4:0xc4], sha256Hash(contentInfoRecords))
+
+	return tmd
+}
+
+// convertNCCH returns the header and the content of the given NCCH, once converted for another
+// container. The NCCH is decrypted if decrypt is true. The SD application flag of the ExHeader is
+// set to the given value, and the ExHeader hash is updated accordingly. The returned modified
+// boolean tells whether the header signature has been invalidated.
+func convertNCCH(r io.ReaderAt, size int64, decrypt, sdApplication bool) (header []byte, data io.Reader, modified bool, err error) {
+	original := make([]byte, 0x200)
+	_, err = r.ReadAt(original, 0)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("ncch: failed to read header: %w", err)
+	}
+
+	if string(original[0x100:0x104]) != "NCCH" {
+		return nil, nil, false, fmt.Errorf("ncch: magic not found")
+	}
+
+	header = append([]byte(nil), original...)
+	encrypted := header[0x18f]&ncchNoCrypto == 0
+	regions := make([]ncchRegion, 0)
+
+	if encrypted && decrypt {
+		regions, err = ncchRegions(r, size, original, false)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		flags := header[0x188:0x190]
+		flags[3] = 0x00
+		flags[7] = flags[7]&^(ncchFixedKey|ncchSeed) | ncchNoCrypto
+	}
+
+	exheaderSize := int64(binary.LittleEndian.Uint32(header[0x180:]))
+	if exheaderSize > 0 {
+		if exheaderSize > 0x400 || 0xa00 > size {
+			return nil, nil, false, fmt.Errorf("ncch: ExHeader exceeds NCCH bounds")
+		}
+
+		var exheaderData io.ReaderAt = io.NewSectionReader(r, 0x200, 0x800)
+		exheaderCipher := func(data io.ReaderAt) io.ReaderAt { return data }
+		if encrypted {
+			block, err := aes.NewCipher(ncchPrimaryKey(original))
+			if err != nil {
+				return nil, nil, false, fmt.Errorf("ncch: failed to initialize ExHeader cipher: %w", err)
+			}
+			iv := ncchIV(original, ncchExHeader, 0x200)
+			exheaderCipher = func(data io.ReaderAt) io.ReaderAt { return ctrutil.NewCTRAt(data, block, iv) }
+		}
+
+		exheader := make([]byte, 0x800)
+		_, err = exheaderCipher(exheaderData).ReadAt(exheader, 0)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("ncch: failed to read ExHeader: %w", err)
+		}
+
+		flag := exheader[0xd] &^ 0x2
+		if sdApplication {
+			flag |= 0x2
+		}
+
+		if flag != exheader[0xd] {
+			exheader[0xd] = flag
+			hash := sha256.Sum256(exheader[:exheaderSize])
+			copy(header[0x160:0x180], hash[:])
+			modified = true
+
+			var patched io.ReaderAt = bytes.NewReader(exheader)
+			if encrypted && !decrypt {
+				patched = exheaderCipher(patched)
+			}
+			region := ncchRegion{offset: 0x200, size: 0x800, data: patched}
+
+			if len(regions) > 0 && regions[0].offset == 0x200 {
+				regions[0] = region
+			} else {
+				regions = append([]ncchRegion{region}, regions...)
+			}
+		}
+	}
+
+	return header, ncchReader(r, size, header, regions), modified, nil
+}
+
+// ConvertCCIToCIA writes a CIA file built from the partitions of the given CCI file.
+//
+// Each partition becomes a content with the same index, except the update partition which is
+// dropped. Partitions are decrypted, and flagged as SD applications. Since a ticket and a TMD
+// cannot be signed, they are generated with empty signatures. A meta section is generated if the
+// first partition has an icon.
+func ConvertCCIToCIA(r io.ReaderAt, size int64, w io.Writer) (*Conversion, error) {
+	cci, err := CheckCCI(r, size, &Options{AllowExtraneousData: true})
+	if err != nil {
+		return nil, err
+	}
+
+	conversion := &Conversion{
+		NotLegit: []string{"ticket", "tmd"},
+	}
+
+	partitions := make([]CCIPartition, 0, len(cci.Partitions))
+	contents := make([]TMDContent, 0, len(cci.Partitions))
+	for _, partition := range cci.Partitions {
+		if partition.Index == 7 {
+			continue
+		}
+
+		_, data, modified, err := convertNCCH(io.NewSectionReader(r, partition.Offset, partition.Size), partition.Size, true, true)
+		if err != nil {
+			return nil, fmt.Errorf("cci: invalid partition %d: %w", partition.Index, err)
+		}
+
+		hash := sha256.New()
+		_, err = io.Copy(hash, data)
+		if err != nil {
+			return nil, fmt.Errorf("cci: failed to read partition %d: %w", partition.Index, err)
+		}
+
+		content := TMDContent{
+			ID:    Hex32(partition.Index),
+			Index: Hex16(partition.Index),
+			Size:  uint64(partition.Size),
+			Hash:  hash.Sum(nil),
+		}
+		if modified {
+			conversion.NotLegit = append(conversion.NotLegit, fmt.Sprintf("content %s NCCH header", content.ID))
+		}
+
+		partitions = append(partitions, partition)
+		contents = append(contents, content)
+	}
+
+	if len(contents) == 0 {
+		return nil, fmt.Errorf("cci: no partition to convert")
+	}
+
+	certs := &Certs.Retail
+	ticket := newUnsignedTicket(certs, cci.TitleID, cci.CardInfo.TitleVersion)
+	tmd := newUnsignedTMD(certs, cci.TitleID, cci.CardInfo.TitleVersion, contents)
+
+	writer, err := NewCIAWriter(w, ticket, tmd, &CIAWriterOptions{Meta: cci.Icon != nil})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, partition := range partitions {
+		_, data, _, err := convertNCCH(io.NewSectionReader(r, partition.Offset, partition.Size), partition.Size, true, true)
+		if err != nil {
+			return nil, fmt.Errorf("cci: invalid partition %d: %w", partition.Index, err)
+		}
+
+		err = writer.WriteContent(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return conversion, nil
+}
+
+// ConvertCIAToCCI writes a CCI file built from the contents of the given CIA file.
+//
+// Each content becomes a partition with the same index, so that only content indexes lower than 8
+// are supported. The title key encryption is removed, but the NCCH encryption is preserved.
+// Partitions are no longer flagged as SD applications. Since the NCSD header cannot be signed, it
+// is generated with an empty signature. The output is padded with 0xff bytes up to the smallest
+// standard cartridge size.
+func ConvertCIAToCCI(r io.ReaderAt, size int64, w io.Writer) (*Conversion, error) {
+	cia, err := OpenCIA(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	conversion := &Conversion{
+		NotLegit: []string{"ncsd header"},
+	}
+
+	const mediaUnit = 0x200
+	header := make([]byte, 0x4000)
+	for i := 0x1200; i < len(header); i++ {
+		header[i] = 0xff
+	}
+	copy(header[0x100:], "NCSD")
+	binary.LittleEndian.PutUint64(header[0x108:], uint64(cia.TMD.TitleID))
+	header[0x188+4] = 1 // CTR platform
+	header[0x188+5] = 1 // Card1 media type
+
+	cardInfo := header[0x200:0x1000]
+	binary.LittleEndian.PutUint32(cardInfo, 0xffffffff) // no writable region on Card1
+	binary.LittleEndian.PutUint32(cardInfo[0x4:], 0)    // no card info flags
+	binary.LittleEndian.PutUint16(cardInfo[0x110:], cia.TMD.TitleVersion)
+
+	offset := int64(len(header))
+	partitions := make([]io.Reader, 0, len(cia.Contents))
+	for index, content := range cia.Contents {
+		if content.Missing {
+			continue
+		}
+		if content.Index >= 8 {
+			return nil, fmt.Errorf("cia: content %s has an index too large for a partition: %s", content.ID, content.Index)
+		}
+
+		data, err := cia.DecryptedContentReader(index)
+		if err != nil {
+			return nil, err
+		}
+		if data.Size()%mediaUnit != 0 {
+			return nil, fmt.Errorf("cia: size of content %s must be a multiple of the media unit", content.ID)
+		}
+
+		ncchHeader, ncch, modified, err := convertNCCH(data, data.Size(), false, false)
+		if err != nil {
+			return nil, fmt.Errorf("cia: invalid content %s: %w", content.ID, err)
+		}
+		if modified {
+			conversion.NotLegit = append(conversion.NotLegit, fmt.Sprintf("partition %d NCCH header", content.Index))
+		}
+
+		binary.LittleEndian.PutUint32(header[0x120+content.Index*0x8:], uint32(offset/mediaUnit))
+		binary.LittleEndian.PutUint32(header[0x124+content.Index*0x8:], uint32(data.Size()/mediaUnit))
+		copy(header[0x190+content.Index*0x8:], ncchHeader[0x108:0x110])
+		if content.Index == 0 {
+			copy(header[0x1100:0x1200], ncchHeader[0x100:0x200])
+		}
+
+		offset += data.Size()
+		partitions = append(partitions, ncch)
+	}
+
+	if binary.LittleEndian.Uint32(header[0x124:]) == 0 {
+		return nil, fmt.Errorf("cia: content 0000 is missing")
+	}
+
+	mediaSize := int64(128 << 20)
+	for mediaSize < offset {
+		mediaSize *= 2
+	}
+	binary.LittleEndian.PutUint32(header[0x104:], uint32(mediaSize/mediaUnit))
+	binary.LittleEndian.PutUint32(cardInfo[0x100:], uint32(offset))
+
+	writer := ctrutil.NewWriter(w)
+	_, err = writer.Write(header)
+	for _, partition := range partitions {
+		if err == nil {
+			_, err = io.Copy(writer, partition)
+		}
+	}
+	padding := bytes.Repeat([]byte{0xff}, 0x10000)
+	for err == nil && writer.Offset() < mediaSize {
+		chunk := padding
+		if remaining := mediaSize - writer.Offset(); remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		_, err = writer.Write(chunk)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cci: failed to write: %w", err)
+	}
+
+	return conversion, nil
+}
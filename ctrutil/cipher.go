@@ -0,0 +1,140 @@
+package ctrutil
+
+import (
+	"crypto/cipher"
+	"io"
+)
+
+type cbcDecrypterAt struct {
+	inner io.ReaderAt
+	block cipher.Block
+	iv    []byte
+}
+
+// NewCBCDecrypterAt wraps the given ReaderAt to decrypt its content in CBC mode.
+//
+// Since each CBC block only depends on the previous ciphertext block, random access is possible.
+// Trailing bytes that don't form a complete block are never returned.
+func NewCBCDecrypterAt(inner io.ReaderAt, block cipher.Block, iv []byte) io.ReaderAt {
+	if len(iv) != block.BlockSize() {
+		panic("IV length must equal block size")
+	}
+
+	return &cbcDecrypterAt{
+		inner: inner,
+		block: block,
+		iv:    append([]byte(nil), iv...),
+	}
+}
+
+func (r *cbcDecrypterAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	blockSize := int64(r.block.BlockSize())
+	start := off - off%blockSize
+	end := off + int64(len(p))
+	end += (blockSize - end%blockSize) % blockSize
+
+	ivStart := start - blockSize
+	if ivStart < 0 {
+		ivStart = 0
+	}
+
+	buf := make([]byte, end-ivStart)
+	n, err := r.inner.ReadAt(buf, ivStart)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	var iv []byte
+	if start == 0 {
+		iv = append([]byte(nil), r.iv...)
+	} else {
+		if int64(n) < blockSize {
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		iv = buf[:blockSize]
+		buf = buf[blockSize:]
+		n -= int(blockSize)
+	}
+
+	n -= n % int(blockSize)
+	plaintext := make([]byte, n)
+	cipher.NewCBCDecrypter(r.block, iv).CryptBlocks(plaintext, buf[:n])
+
+	skip := int(off - start)
+	if skip >= n {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	copied := copy(p, plaintext[skip:])
+	if copied < len(p) && err == nil {
+		err = io.EOF
+	}
+	return copied, err
+}
+
+type ctrAt struct {
+	inner io.ReaderAt
+	block cipher.Block
+	iv    []byte
+}
+
+// NewCTRAt wraps the given ReaderAt to encrypt or decrypt its content in CTR mode.
+//
+// The counter of each block is derived from its offset, so that random access is possible.
+func NewCTRAt(inner io.ReaderAt, block cipher.Block, iv []byte) io.ReaderAt {
+	if len(iv) != block.BlockSize() {
+		panic("IV length must equal block size")
+	}
+
+	return &ctrAt{
+		inner: inner,
+		block: block,
+		iv:    append([]byte(nil), iv...),
+	}
+}
+
+func (r *ctrAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n, err := r.inner.ReadAt(p, off)
+
+	NewCTR(r.block, r.iv, off).XORKeyStream(p[:n], p[:n])
+
+	return n, err
+}
+
+// NewCTR returns a CTR stream positioned at the given offset of the keystream.
+func NewCTR(block cipher.Block, iv []byte, offset int64) cipher.Stream {
+	if len(iv) != block.BlockSize() {
+		panic("IV length must equal block size")
+	}
+
+	blockSize := int64(block.BlockSize())
+	counter := append([]byte(nil), iv...)
+	carry := uint64(offset / blockSize)
+	for i := len(counter) - 1; i >= 0 && carry != 0; i-- {
+		carry += uint64(counter[i])
+		counter[i] = byte(carry)
+		carry >>= 8
+	}
+
+	stream := cipher.NewCTR(block, counter)
+	skip := make([]byte, offset%blockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
@@ -0,0 +1,43 @@
+package ctrutil
+
+import (
+	"io"
+)
+
+// Writer wraps another Writer to add some capabilities.
+type Writer struct {
+	inner  io.Writer
+	offset int64
+}
+
+var _ io.Writer = &Writer{}
+
+// NewWriter wraps the given Writer to add some capabilities.
+func NewWriter(inner io.Writer) *Writer {
+	if inner, ok := inner.(*Writer); ok && inner.offset == 0 {
+		return inner
+	}
+
+	return &Writer{
+		inner:  inner,
+		offset: 0,
+	}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.inner.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
+
+// Offset of the next byte to be written.
+func (w *Writer) Offset() int64 {
+	return w.offset
+}
+
+// Align writes zeros until the offset is a multiple of the given alignment.
+func (w *Writer) Align(alignment int64) error {
+	padding := (alignment - w.offset%alignment) % alignment
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
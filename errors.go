@@ -0,0 +1,155 @@
+package ctrsigcheck
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors matching the corresponding error types with errors.Is.
+var (
+	ErrHashMismatch       = errors.New("hash mismatch")
+	ErrUnexpectedIssuer   = errors.New("unexpected issuer")
+	ErrMissingContent     = errors.New("missing content")
+	ErrExtraneousData     = errors.New("extraneous data")
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	ErrMissingKey         = errors.New("missing key")
+)
+
+// Location of a problem detected in a file.
+//
+// Offset is relative to the beginning of Structure (e.g. "cia", "tmd" or "ncch"). Content
+// information is only set when the problem concerns a specific content.
+type Location struct {
+	Structure    string
+	ContentID    *Hex32 `json:",omitempty"`
+	ContentIndex *Hex16 `json:",omitempty"`
+	Offset       int64
+}
+
+func contentLocation(structure string, content *TMDContent, offset int64) Location {
+	id := content.ID
+	index := content.Index
+	return Location{
+		Structure:    structure,
+		ContentID:    &id,
+		ContentIndex: &index,
+		Offset:       offset,
+	}
+}
+
+// HashMismatchError reports a SHA-256 hash that does not match the expected value.
+type HashMismatchError struct {
+	Location
+	Subject string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("%s: invalid hash for %s", e.Structure, e.Subject)
+}
+
+// Is allows to match ErrHashMismatch.
+func (e *HashMismatchError) Is(target error) bool {
+	return target == ErrHashMismatch
+}
+
+// UnexpectedIssuerError reports a signature issuer that does not match any known certificate.
+type UnexpectedIssuerError struct {
+	Location
+	Issuer string
+}
+
+func (e *UnexpectedIssuerError) Error() string {
+	return fmt.Sprintf("%s: unexpected issuer: %s", e.Structure, e.Issuer)
+}
+
+// Is allows to match ErrUnexpectedIssuer.
+func (e *UnexpectedIssuerError) Is(target error) bool {
+	return target == ErrUnexpectedIssuer
+}
+
+// MissingContentError reports a required content that is missing.
+type MissingContentError struct {
+	Location
+}
+
+func (e *MissingContentError) Error() string {
+	return fmt.Sprintf("%s: required content %s is missing", e.Structure, e.ContentID)
+}
+
+// Is allows to match ErrMissingContent.
+func (e *MissingContentError) Is(target error) bool {
+	return target == ErrMissingContent
+}
+
+// ExtraneousDataError reports unexpected data after the end of a file.
+type ExtraneousDataError struct {
+	Location
+}
+
+func (e *ExtraneousDataError) Error() string {
+	return fmt.Sprintf("%s: extraneous data after %d bytes", e.Structure, e.Offset)
+}
+
+// Is allows to match ErrExtraneousData.
+func (e *ExtraneousDataError) Is(target error) bool {
+	return target == ErrExtraneousData
+}
+
+// UnsupportedVersionError reports a format version that is not supported.
+type UnsupportedVersionError struct {
+	Location
+	Version uint
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("%s: unsupported version: %d", e.Structure, e.Version)
+}
+
+// Is allows to match ErrUnsupportedVersion.
+func (e *UnsupportedVersionError) Is(target error) bool {
+	return target == ErrUnsupportedVersion
+}
+
+// MissingKeyError reports encrypted data that cannot be decrypted because the needed key is not
+// known.
+type MissingKeyError struct {
+	Location
+	Key string
+}
+
+func (e *MissingKeyError) Error() string {
+	return fmt.Sprintf("%s: missing key: %s", e.Structure, e.Key)
+}
+
+// Is allows to match ErrMissingKey.
+func (e *MissingKeyError) Is(target error) bool {
+	return target == ErrMissingKey
+}
+
+// RomFSBlock locates a block of the IVFC hash tree of a RomFS, from level 1 to level 3.
+type RomFSBlock struct {
+	Level  int
+	Offset int64
+}
+
+// RomFSHashError reports blocks of a RomFS whose hashes don't match the IVFC hash tree.
+//
+// Location designates the first failing block. Blocks lists the failing blocks, up to a limit,
+// while Count is the total number of failing blocks.
+type RomFSHashError struct {
+	Location
+	Blocks []RomFSBlock
+	Count  int
+}
+
+func (e *RomFSHashError) Error() string {
+	if e.Count == 1 {
+		return fmt.Sprintf("%s: invalid hash for block at offset %d", e.Structure, e.Offset)
+	}
+	return fmt.Sprintf("%s: invalid hash for %d blocks, starting at offset %d", e.Structure, e.Count, e.Offset)
+}
+
+// Is allows to match ErrHashMismatch.
+func (e *RomFSHashError) Is(target error) bool {
+	return target == ErrHashMismatch
+}
@@ -2,22 +2,65 @@ package ctrsigcheck
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/connesc/ctrsigcheck/ctrutil"
 )
 
+// ExeFSFile describes a file embedded in an ExeFS.
+//
+// Offset is relative to the end of the 0x200-byte ExeFS header.
+type ExeFSFile struct {
+	Name   string
+	Offset int64
+	Size   int64
+	Hash   Hex
+}
+
 // ExeFS describes the result of ExeFS parsing.
 type ExeFS struct {
-	Icon *SMDH
+	Files []ExeFSFile
+	Icon  *SMDH
 }
 
 // ParseExeFS extracts some information from the given ExeFS file.
 //
 // No integrity checks are performed.
 func ParseExeFS(input io.Reader) (*ExeFS, error) {
+	return ParseExeFSWithOptions(input, nil)
+}
+
+// ParseExeFSWithOptions is like ParseExeFS, but its behavior can be adjusted with the given
+// options. A nil options is equivalent to the zero value.
+func ParseExeFSWithOptions(input io.Reader, options *Options) (*ExeFS, error) {
+	return readExeFS(input, 0, options.orDefault(), false, nil)
+}
+
+// CheckExeFS reads the given ExeFS file and verifies its integrity.
+//
+// Files must be stored in the order of their headers, without overlapping each other, and must
+// fit in the given size. The SHA-256 hash of each file is verified against the hash table at the
+// end of the header.
+//
+// The ExeFS is read sequentially, but only up to the end of the last file: the caller is
+// responsible for consuming the rest.
+func CheckExeFS(input io.Reader, size int64) (*ExeFS, error) {
+	return CheckExeFSWithOptions(input, size, nil)
+}
+
+// CheckExeFSWithOptions is like CheckExeFS, but its behavior can be adjusted with the given
+// options. A nil options is equivalent to the zero value.
+func CheckExeFSWithOptions(input io.Reader, size int64, options *Options) (*ExeFS, error) {
+	return readExeFS(input, size, options.orDefault(), true, nil)
+}
+
+// readExeFS parses the given ExeFS, and verifies it if verify is true. The hashes of the files for
+// which skipHash returns true are not verified.
+func readExeFS(input io.Reader, size int64, options *Options, verify bool, skipHash func(name string) bool) (*ExeFS, error) {
 	reader := ctrutil.NewReader(input)
 
 	header := make([]byte, 0x200)
@@ -26,40 +69,92 @@ func ParseExeFS(input io.Reader) (*ExeFS, error) {
 		return nil, fmt.Errorf("exefs: failed to read header: %w", err)
 	}
 
-	var iconOffset uint32
-	var iconSize uint32
+	files := make([]ExeFSFile, 0, 10)
+	end := int64(0)
 
 	for i := 0; i < 10; i++ {
 		fileHeader := header[i*0x10 : (i+1)*0x10]
 		fileName := string(bytes.TrimRight(fileHeader[:0x8], "\x00"))
+		if fileName == "" {
+			continue
+		}
 
-		if fileName == "icon" {
-			iconOffset = binary.LittleEndian.Uint32(fileHeader[0x8:])
-			iconSize = binary.LittleEndian.Uint32(fileHeader[0xc:])
+		file := ExeFSFile{
+			Name:   fileName,
+			Offset: int64(binary.LittleEndian.Uint32(fileHeader[0x8:])),
+			Size:   int64(binary.LittleEndian.Uint32(fileHeader[0xc:])),
+			Hash:   append([]byte(nil), header[0x200-(i+1)*0x20:0x200-i*0x20]...),
 		}
+
+		if verify {
+			if len(files) > 0 && file.Offset < files[len(files)-1].Offset {
+				return nil, fmt.Errorf("exefs: file %q is out of order", fileName)
+			}
+			if file.Offset < end {
+				return nil, fmt.Errorf("exefs: file %q overlaps previous file", fileName)
+			}
+			if 0x200+file.Offset+file.Size > size {
+				return nil, fmt.Errorf("exefs: file %q exceeds ExeFS size", fileName)
+			}
+			end = file.Offset + file.Size
+		}
+
+		files = append(files, file)
 	}
 
-	var icon *SMDH
+	exefs := &ExeFS{
+		Files: files,
+	}
 
-	if iconSize > 0 {
-		if iconSize != 0x36c0 {
-			return nil, fmt.Errorf("exefs: when present, icon must have size %d, got %d", 0x36c0, iconSize)
+	for _, file := range files {
+		isIcon := file.Name == "icon" && file.Size > 0
+		if isIcon && file.Size != 0x36c0 {
+			return nil, fmt.Errorf("exefs: when present, icon must have size %d, got %d", 0x36c0, file.Size)
 		}
 
-		err = reader.Discard(int64(iconOffset))
+		parseIcon := isIcon && !options.SkipSMDH
+		verifyHash := verify && (skipHash == nil || !skipHash(file.Name))
+		if !parseIcon && !verifyHash {
+			continue
+		}
+
+		if reader.Offset() > 0x200+file.Offset {
+			return nil, fmt.Errorf("exefs: file %q overlaps previous file", file.Name)
+		}
+		err = reader.Discard(0x200 + file.Offset - reader.Offset())
 		if err != nil {
-			return nil, fmt.Errorf("exefs: failed to jump to icon: %w", err)
+			return nil, fmt.Errorf("exefs: failed to jump to file %q: %w", file.Name, err)
 		}
 
-		data := io.LimitReader(reader, int64(iconSize))
+		hash := sha256.New()
+		data := io.TeeReader(io.LimitReader(reader, file.Size), hash)
 
-		icon, err = ParseSMDH(data)
+		if parseIcon {
+			exefs.Icon, err = ParseSMDH(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !verifyHash {
+			continue
+		}
+
+		_, err = io.Copy(ioutil.Discard, data)
+		if err == nil && reader.Offset() < 0x200+file.Offset+file.Size {
+			err = io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("exefs: failed to read file %q: %w", file.Name, err)
+		}
+
+		if !bytes.Equal(hash.Sum(nil), file.Hash) {
+			return nil, &HashMismatchError{
+				Location: Location{Structure: "exefs", Offset: 0x200 + file.Offset},
+				Subject:  fmt.Sprintf("file %q", file.Name),
+			}
 		}
 	}
 
-	return &ExeFS{
-		Icon: icon,
-	}, nil
+	return exefs, nil
 }
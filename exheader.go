@@ -0,0 +1,269 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// ExHeader describes the extended header of an NCCH.
+//
+// The access control info is declared twice: by the application itself (ACI), and by the access
+// descriptor that restricts it (AccessDesc).
+type ExHeader struct {
+	SCI        ExHeaderSCI
+	ACI        ExHeaderACI
+	AccessDesc ExHeaderACI
+	raw        []byte
+}
+
+// ExHeaderSCI describes the system control info of an ExHeader.
+type ExHeaderSCI struct {
+	ApplicationTitle string
+	CompressedCode   bool
+	SDApplication    bool
+	RemasterVersion  uint16
+	Text             ExHeaderCodeSegment
+	ReadOnly         ExHeaderCodeSegment
+	Data             ExHeaderCodeSegment
+	StackSize        uint32
+	BSSSize          uint32
+	Dependencies     []Hex64
+	SaveDataSize     uint64
+	JumpID           Hex64
+}
+
+// ExHeaderCodeSegment describes a segment of the code of an application.
+type ExHeaderCodeSegment struct {
+	Address       Hex32
+	PhysicalPages uint32
+	Size          uint32
+}
+
+// ExHeaderACI describes the access control info of an ExHeader.
+type ExHeaderACI struct {
+	ARM11LocalCaps    ExHeaderARM11LocalCaps
+	ARM11KernelCaps   ExHeaderARM11KernelCaps
+	ARM9AccessControl ExHeaderARM9AccessControl
+}
+
+// ExHeaderARM11LocalCaps describes the ARM11 local system capabilities of an application.
+type ExHeaderARM11LocalCaps struct {
+	ProgramID             Hex64
+	CoreVersion           uint32
+	EnableL2Cache         bool
+	HighCPUSpeed          bool
+	New3DSSystemMode      uint8
+	IdealProcessor        uint8
+	AffinityMask          uint8
+	SystemMode            uint8
+	Priority              uint8
+	ResourceLimitCategory uint8
+	StorageInfo           ExHeaderStorageInfo
+	Services              []string
+}
+
+// ExHeaderStorageInfo describes the storage that an application is allowed to access.
+//
+// If ExtendedSaveDataAccess is set, ExtSaveDataID and StorageAccessibleUniqueIDs contain
+// additional accessible save data IDs instead.
+type ExHeaderStorageInfo struct {
+	ExtSaveDataID              Hex64
+	SystemSaveDataIDs          []Hex32
+	StorageAccessibleUniqueIDs Hex64
+	FSAccess                   Hex64
+	NoRomFS                    bool
+	ExtendedSaveDataAccess     bool
+}
+
+// ExHeaderARM11KernelCaps describes the ARM11 kernel capabilities of an application.
+//
+// Descriptors contains every descriptor, including those that are not decoded in other fields
+// (e.g. memory mappings).
+type ExHeaderARM11KernelCaps struct {
+	KernelVersion   string
+	HandleTableSize uint32
+	Flags           Hex32
+	Syscalls        []Hex8
+	Interrupts      []uint
+	Descriptors     []Hex32
+}
+
+// ExHeaderARM9AccessControl describes the ARM9 access control of an application.
+type ExHeaderARM9AccessControl struct {
+	Permissions       []string
+	Descriptors       Hex
+	DescriptorVersion uint8
+}
+
+// arm9Permissions names the bits of the ARM9 access control descriptors.
+var arm9Permissions = []string{
+	"MountNand",
+	"MountNandRoWrite",
+	"MountTwln",
+	"MountWnand",
+	"MountCardSpi",
+	"UseSdif3",
+	"CreateSeed",
+	"UseCardSpi",
+	"SDApplication",
+	"MountSdmcWrite",
+}
+
+// ParseExHeader extracts the content of the given ExHeader, which must have been decrypted.
+//
+// No integrity checks are performed.
+func ParseExHeader(input io.Reader) (*ExHeader, error) {
+	reader := ctrutil.NewReader(input)
+
+	raw := make([]byte, 0x800)
+	_, err := io.ReadFull(reader, raw)
+	if err != nil {
+		return nil, fmt.Errorf("exheader: failed to read data: %w", err)
+	}
+
+	sci := raw[:0x200]
+
+	dependencies := make([]Hex64, 0)
+	for i := 0; i < 0x30; i++ {
+		dependency := binary.LittleEndian.Uint64(sci[0x40+i*0x8:])
+		if dependency != 0 {
+			dependencies = append(dependencies, Hex64(dependency))
+		}
+	}
+
+	return &ExHeader{
+		SCI: ExHeaderSCI{
+			ApplicationTitle: string(bytes.TrimRight(sci[:0x8], "\x00")),
+			CompressedCode:   sci[0xd]&0x1 != 0,
+			SDApplication:    sci[0xd]&0x2 != 0,
+			RemasterVersion:  binary.LittleEndian.Uint16(sci[0xe:]),
+			Text:             parseExHeaderCodeSegment(sci[0x10:]),
+			StackSize:        binary.LittleEndian.Uint32(sci[0x1c:]),
+			ReadOnly:         parseExHeaderCodeSegment(sci[0x20:]),
+			Data:             parseExHeaderCodeSegment(sci[0x30:]),
+			BSSSize:          binary.LittleEndian.Uint32(sci[0x3c:]),
+			Dependencies:     dependencies,
+			SaveDataSize:     binary.LittleEndian.Uint64(sci[0x1c0:]),
+			JumpID:           Hex64(binary.LittleEndian.Uint64(sci[0x1c8:])),
+		},
+		ACI:        parseExHeaderACI(raw[0x200:0x400]),
+		AccessDesc: parseExHeaderACI(raw[0x600:0x800]),
+		raw:        raw,
+	}, nil
+}
+
+func parseExHeaderCodeSegment(data []byte) ExHeaderCodeSegment {
+	return ExHeaderCodeSegment{
+		Address:       Hex32(binary.LittleEndian.Uint32(data)),
+		PhysicalPages: binary.LittleEndian.Uint32(data[0x4:]),
+		Size:          binary.LittleEndian.Uint32(data[0x8:]),
+	}
+}
+
+func parseExHeaderACI(aci []byte) ExHeaderACI {
+	local := aci[:0x170]
+
+	storage := local[0x30:0x50]
+	systemSaveDataIDs := make([]Hex32, 0, 2)
+	for i := 0; i < 2; i++ {
+		id := binary.LittleEndian.Uint32(storage[0x8+i*0x4:])
+		if id != 0 {
+			systemSaveDataIDs = append(systemSaveDataIDs, Hex32(id))
+		}
+	}
+
+	services := make([]string, 0)
+	for i := 0; i < 0x22; i++ {
+		service := string(bytes.TrimRight(local[0x50+i*0x8:0x58+i*0x8], "\x00"))
+		if service != "" {
+			services = append(services, service)
+		}
+	}
+
+	arm9 := aci[0x1f0:0x200]
+	arm9Flags := binary.LittleEndian.Uint64(arm9)
+	permissions := make([]string, 0)
+	for bit, permission := range arm9Permissions {
+		if arm9Flags&(1<<bit) != 0 {
+			permissions = append(permissions, permission)
+		}
+	}
+
+	return ExHeaderACI{
+		ARM11LocalCaps: ExHeaderARM11LocalCaps{
+			ProgramID:             Hex64(binary.LittleEndian.Uint64(local)),
+			CoreVersion:           binary.LittleEndian.Uint32(local[0x8:]),
+			EnableL2Cache:         local[0xc]&0x1 != 0,
+			HighCPUSpeed:          local[0xc]&0x2 != 0,
+			New3DSSystemMode:      local[0xd] & 0xf,
+			IdealProcessor:        local[0xe] & 0x3,
+			AffinityMask:          (local[0xe] >> 2) & 0x3,
+			SystemMode:            local[0xe] >> 4,
+			Priority:              local[0xf],
+			ResourceLimitCategory: local[0x16f],
+			StorageInfo: ExHeaderStorageInfo{
+				ExtSaveDataID:              Hex64(binary.LittleEndian.Uint64(storage)),
+				SystemSaveDataIDs:          systemSaveDataIDs,
+				StorageAccessibleUniqueIDs: Hex64(binary.LittleEndian.Uint64(storage[0x10:])),
+				FSAccess:                   Hex64(binary.LittleEndian.Uint64(storage[0x18:]) & 0x00ffffffffffffff),
+				NoRomFS:                    storage[0x1f]&0x1 != 0,
+				ExtendedSaveDataAccess:     storage[0x1f]&0x2 != 0,
+			},
+			Services: services,
+		},
+		ARM11KernelCaps: parseExHeaderKernelCaps(aci[0x170:0x1f0]),
+		ARM9AccessControl: ExHeaderARM9AccessControl{
+			Permissions:       permissions,
+			Descriptors:       append([]byte(nil), arm9[:0xf]...),
+			DescriptorVersion: arm9[0xf],
+		},
+	}
+}
+
+// parseExHeaderKernelCaps decodes the ARM11 kernel capability descriptors. Each descriptor is
+// identified by the number of leading ones; unused descriptors are filled with ones. Unknown
+// descriptors are only reported as raw descriptors.
+func parseExHeaderKernelCaps(data []byte) ExHeaderARM11KernelCaps {
+	caps := ExHeaderARM11KernelCaps{
+		Syscalls:    make([]Hex8, 0),
+		Interrupts:  make([]uint, 0),
+		Descriptors: make([]Hex32, 0),
+	}
+
+	for i := 0; i < 0x1c; i++ {
+		descriptor := binary.LittleEndian.Uint32(data[i*0x4:])
+		if descriptor == 0xffffffff {
+			continue
+		}
+		caps.Descriptors = append(caps.Descriptors, Hex32(descriptor))
+
+		switch {
+		case descriptor&0xf0000000 == 0xe0000000:
+			for shift := 0; shift < 28; shift += 7 {
+				interrupt := uint(descriptor >> shift & 0x7f)
+				if interrupt != 0x7f {
+					caps.Interrupts = append(caps.Interrupts, interrupt)
+				}
+			}
+		case descriptor&0xf8000000 == 0xf0000000:
+			index := descriptor >> 24 & 0x7
+			for bit := uint32(0); bit < 24; bit++ {
+				if descriptor&(1<<bit) != 0 {
+					caps.Syscalls = append(caps.Syscalls, Hex8(index*24+bit))
+				}
+			}
+		case descriptor&0xfe000000 == 0xfc000000:
+			caps.KernelVersion = fmt.Sprintf("%d.%d", descriptor>>8&0xff, descriptor&0xff)
+		case descriptor&0xff000000 == 0xfe000000:
+			caps.HandleTableSize = descriptor & 0x7ffff
+		case descriptor&0xff800000 == 0xff000000:
+			caps.Flags = Hex32(descriptor & 0x7fffff)
+		}
+	}
+
+	return caps
+}
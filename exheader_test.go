@@ -0,0 +1,102 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// buildExHeader returns a decrypted ExHeader with the given dependencies, and with the given
+// services and system save data IDs in both its ACI and its access descriptor.
+func buildExHeader(dependencies []uint64, services []string, saveDataIDs []uint32) []byte {
+	raw := make([]byte, 0x800)
+	copy(raw, "Test")
+	for i, dependency := range dependencies {
+		binary.LittleEndian.PutUint64(raw[0x40+i*0x8:], dependency)
+	}
+
+	for _, aci := range [][]byte{raw[0x200:0x400], raw[0x600:0x800]} {
+		binary.LittleEndian.PutUint64(aci, 0x0004000000123400)
+		storage := aci[0x30:0x50]
+		binary.LittleEndian.PutUint64(storage, 0x00000000000abcde)
+		for i, id := range saveDataIDs {
+			binary.LittleEndian.PutUint32(storage[0x8+i*0x4:], id)
+		}
+		binary.LittleEndian.PutUint64(storage[0x18:], 0x0200000000000003)
+		for i, service := range services {
+			copy(aci[0x50+i*0x8:0x58+i*0x8], service)
+		}
+		aci[0x16f] = 0x1
+		for i := 0; i < 0x1c; i++ {
+			binary.LittleEndian.PutUint32(aci[0x170+i*0x4:], 0xffffffff)
+		}
+	}
+
+	return raw
+}
+
+func TestParseExHeader(t *testing.T) {
+	fullServices := make([]string, 0x22)
+	for i := range fullServices {
+		fullServices[i] = "srv:" + string(rune('A'+i))
+	}
+
+	tests := []struct {
+		name         string
+		dependencies []uint64
+		services     []string
+		saveDataIDs  []uint32
+	}{
+		{"empty", nil, nil, nil},
+		{"typical", []uint64{0x0004013000002c02, 0x0004013000003202}, []string{"APT:U", "fs:USER", "gsp::Gpu", "hid:USER"}, []uint32{0x00020000}},
+		{"full", []uint64{0x0004013000002c02}, fullServices, []uint32{0x00020000, 0x00020001}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw := buildExHeader(test.dependencies, test.services, test.saveDataIDs)
+			exheader, err := ParseExHeader(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("ParseExHeader: %v", err)
+			}
+
+			dependencies := make([]Hex64, 0)
+			for _, dependency := range test.dependencies {
+				dependencies = append(dependencies, Hex64(dependency))
+			}
+			if !reflect.DeepEqual(exheader.SCI.Dependencies, dependencies) {
+				t.Errorf("Dependencies = %v, want %v", exheader.SCI.Dependencies, dependencies)
+			}
+
+			services := append(make([]string, 0), test.services...)
+			saveDataIDs := make([]Hex32, 0)
+			for _, id := range test.saveDataIDs {
+				saveDataIDs = append(saveDataIDs, Hex32(id))
+			}
+			for name, aci := range map[string]ExHeaderACI{"ACI": exheader.ACI, "AccessDesc": exheader.AccessDesc} {
+				caps := aci.ARM11LocalCaps
+				if caps.ProgramID != 0x0004000000123400 {
+					t.Errorf("%s.ProgramID = %s", name, caps.ProgramID)
+				}
+				if caps.ResourceLimitCategory != 0x1 {
+					t.Errorf("%s.ResourceLimitCategory = %d, want 1", name, caps.ResourceLimitCategory)
+				}
+				if !reflect.DeepEqual(caps.Services, services) {
+					t.Errorf("%s.Services = %q, want %q", name, caps.Services, services)
+				}
+
+				storage := caps.StorageInfo
+				if storage.ExtSaveDataID != 0xabcde {
+					t.Errorf("%s.ExtSaveDataID = %s, want 00000000000ABCDE", name, storage.ExtSaveDataID)
+				}
+				if !reflect.DeepEqual(storage.SystemSaveDataIDs, saveDataIDs) {
+					t.Errorf("%s.SystemSaveDataIDs = %v, want %v", name, storage.SystemSaveDataIDs, saveDataIDs)
+				}
+				if storage.FSAccess != 0x3 || storage.NoRomFS || !storage.ExtendedSaveDataAccess {
+					t.Errorf("%s: FSAccess = %s, NoRomFS = %v, ExtendedSaveDataAccess = %v", name, storage.FSAccess, storage.NoRomFS, storage.ExtendedSaveDataAccess)
+				}
+			}
+		})
+	}
+}
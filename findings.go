@@ -0,0 +1,75 @@
+package ctrsigcheck
+
+// Severity of a Finding.
+type Severity string
+
+// Known severities.
+const (
+	// SeverityError designates a problem that makes the file invalid.
+	SeverityError Severity = "Error"
+
+	// SeverityWarning designates a problem that has been tolerated because of the options.
+	SeverityWarning Severity = "Warning"
+)
+
+// Finding describes a problem detected while validating a file.
+//
+// Offset is the position in the file where the problem has been detected, or where the affected
+// section starts. Err is the underlying error, which can be inspected with errors.As.
+type Finding struct {
+	Severity Severity
+	Section  string
+	Offset   int64
+	Message  string
+	Err      error `json:"-"`
+}
+
+// findings decides whether a problem aborts the verification or is collected as a finding.
+type findings struct {
+	collect bool
+	list    []Finding
+
+	// Section being verified, used to locate fatal errors.
+	section string
+	offset  int64
+}
+
+// enter records the section being verified.
+func (f *findings) enter(section string, offset int64) {
+	f.section = section
+	f.offset = offset
+}
+
+// fatal reports a problem that stopped the verification.
+func (f *findings) fatal(err error) {
+	f.problem(f.section, f.offset, err)
+}
+
+// problem reports a problem that makes the file invalid. The returned error must be propagated:
+// it is nil only if findings are collected.
+func (f *findings) problem(section string, offset int64, err error) error {
+	if !f.collect {
+		return err
+	}
+	f.list = append(f.list, Finding{
+		Severity: SeverityError,
+		Section:  section,
+		Offset:   offset,
+		Message:  err.Error(),
+		Err:      err,
+	})
+	return nil
+}
+
+// tolerated reports a problem that has been tolerated because of the options.
+func (f *findings) tolerated(section string, offset int64, err error) {
+	if f.collect {
+		f.list = append(f.list, Finding{
+			Severity: SeverityWarning,
+			Section:  section,
+			Offset:   offset,
+			Message:  err.Error(),
+			Err:      err,
+		})
+	}
+}
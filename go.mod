@@ -1,6 +1,6 @@
 module github.com/connesc/ctrsigcheck
 
-go 1.14
+go 1.16
 
 require (
 	github.com/connesc/cipherio v0.1.0
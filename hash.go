@@ -1,9 +1,16 @@
 package ctrsigcheck
 
 import (
+	"crypto/sha1"
 	"crypto/sha256"
 )
 
+func sha1Hash(payload []byte) []byte {
+	hash := sha1.New()
+	hash.Write(payload)
+	return hash.Sum(nil)
+}
+
 func sha256Hash(payload []byte) []byte {
 	hash := sha256.New()
 	hash.Write(payload)
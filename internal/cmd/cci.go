@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cciCmd.Flags().AddFlagSet(&processFlags)
+	cciCmd.Flags().AddFlagSet(&optionsFlags)
+	rootCmd.AddCommand(cciCmd)
+}
+
+type cciFile struct {
+	File *string
+	*ctrsigcheck.CCI
+}
+
+var cciCmd = &cobra.Command{
+	Use:   "cci <file...>",
+	Short: "Check CCI files",
+	Long:  "Check CCI files (cartridge images, usually with the .3ds extension) given as arguments",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		encoder := newEncoder(os.Stdout)
+
+		for i := range args {
+			filename := &args[i]
+			file, err := os.Open(*filename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to open file: %v\n", err)
+				os.Exit(2)
+			}
+
+			info, err := file.Stat()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to stat file: %v\n", err)
+				os.Exit(2)
+			}
+
+			cci, err := ctrsigcheck.CheckCCI(file, info.Size(), options())
+			if err != nil {
+				exitInvalid(filename, err)
+			}
+			file.Close()
+
+			encoder.Encode(cciFile{
+				File: filename,
+				CCI:  cci,
+			})
+		}
+	},
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+var cdnVersion *int
+
+func init() {
+	cdnCmd.Flags().AddFlagSet(&processFlags)
+	cdnCmd.Flags().AddFlagSet(&optionsFlags)
+	cdnVersion = cdnCmd.Flags().IntP("version", "v", -1, "read the TMD of the given version (tmd.<version>) instead of the latest one")
+	rootCmd.AddCommand(cdnCmd)
+}
+
+type cdnDir struct {
+	Dir string
+	*ctrsigcheck.CDN
+}
+
+var cdnCmd = &cobra.Command{
+	Use:   "cdn <dir...>",
+	Short: "Check directories of CDN files",
+	Long: "Check directories containing CDN files (cetk, tmd or tmd.<version>, and content files " +
+		"named after their 8-hex-digit ID)",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		encoder := newEncoder(os.Stdout)
+
+		for _, dir := range args {
+			var cdn *ctrsigcheck.CDN
+			var err error
+			if *cdnVersion >= 0 {
+				cdn, err = ctrsigcheck.CheckCDNVersion(dir, uint16(*cdnVersion), options())
+			} else {
+				cdn, err = ctrsigcheck.CheckCDN(dir, options())
+			}
+			if err != nil {
+				exitInvalid(&dir, err)
+			}
+
+			encoder.Encode(cdnDir{
+				Dir: dir,
+				CDN: cdn,
+			})
+		}
+	},
+}
@@ -9,14 +9,23 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	collectFindings *bool
+	restoreCIATMD   *bool
+)
+
 func init() {
 	ciaCmd.Flags().AddFlagSet(&processFlags)
+	ciaCmd.Flags().AddFlagSet(&optionsFlags)
+	collectFindings = ciaCmd.Flags().BoolP("all-problems", "a", false, "report every detected problem instead of stopping at the first one")
+	restoreCIATMD = ciaCmd.Flags().Bool("restore-tmd", false, "rewrite files in place with their original TMD, when modified on decryption")
 	rootCmd.AddCommand(ciaCmd)
 }
 
 type ciaFile struct {
 	File *string
 	*ctrsigcheck.CIA
+	Findings []ctrsigcheck.Finding `json:",omitempty"`
 }
 
 var ciaCmd = &cobra.Command{
@@ -25,15 +34,61 @@ var ciaCmd = &cobra.Command{
 	Long:  "Check CIA files given as arguments, or stdin if none is given",
 	Run: func(cmd *cobra.Command, args []string) {
 		processFiles(args, func(filename *string, input io.Reader) interface{} {
-			cia, err := ctrsigcheck.CheckCIA(input)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Invalid CIA: %v\n", err)
-				os.Exit(3)
-			}
-			return ciaFile{
-				File: filename,
-				CIA:  cia,
+			if *restoreCIATMD {
+				restoreCIATMDFile(filename)
 			}
+			return checkCIAFile(filename, input)
 		})
 	},
 }
+
+func checkCIAFile(filename *string, input io.Reader) interface{} {
+	if *collectFindings {
+		cia, findings := ctrsigcheck.ValidateCIA(input, options())
+		for _, finding := range findings {
+			if finding.Severity == ctrsigcheck.SeverityError {
+				failed = true
+			}
+		}
+		return ciaFile{
+			File:     filename,
+			CIA:      cia,
+			Findings: findings,
+		}
+	}
+
+	cia, err := ctrsigcheck.CheckCIAWithOptions(input, options())
+	if err != nil {
+		exitInvalid(filename, err)
+	}
+	return ciaFile{
+		File: filename,
+		CIA:  cia,
+	}
+}
+
+// restoreCIATMDFile rewrites the TMD of the given CIA file in place with its original form.
+func restoreCIATMDFile(filename *string) {
+	if filename == nil {
+		fmt.Fprintln(os.Stderr, "Unable to restore TMD of stdin")
+		os.Exit(2)
+	}
+
+	file, err := os.OpenFile(*filename, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open file: %v\n", err)
+		os.Exit(2)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to stat file: %v\n", err)
+		os.Exit(2)
+	}
+
+	err = ctrsigcheck.RestoreCIATMD(file, info.Size())
+	if err != nil {
+		exitInvalid(filename, err)
+	}
+}
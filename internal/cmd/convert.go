@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	convertCmd.Flags().AddFlagSet(&processFlags)
+	convertCmd.Flags().AddFlagSet(&optionsFlags)
+	rootCmd.AddCommand(convertCmd)
+}
+
+type convertedFile struct {
+	File     string
+	NotLegit []string
+	CIA      *ctrsigcheck.CIA `json:",omitempty"`
+	CCI      *ctrsigcheck.CCI `json:",omitempty"`
+}
+
+var convertCmd = &cobra.Command{
+	Use:   "convert <file> <output>",
+	Short: "Convert between CCI and CIA files",
+	Long: "Convert a CCI file to a CIA file, or a CIA file to a CCI file, depending on the input " +
+		"format. The result is then checked as the cci or cia command would, and the parts that are " +
+		"no longer legit are reported.",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename, output := args[0], args[1]
+
+		file, err := os.Open(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open file: %v\n", err)
+			os.Exit(2)
+		}
+		defer file.Close()
+
+		info, err := file.Stat()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to stat file: %v\n", err)
+			os.Exit(2)
+		}
+
+		magic := make([]byte, 0x4)
+		_, err = file.ReadAt(magic, 0x100)
+		if err != nil && err != io.EOF {
+			fmt.Fprintf(os.Stderr, "Unable to read file: %v\n", err)
+			os.Exit(2)
+		}
+		fromCCI := string(magic) == "NCSD"
+
+		if !fromCCI {
+			_, err = ctrsigcheck.CheckCIAWithOptions(file, options())
+			if err != nil {
+				exitInvalid(&filename, err)
+			}
+		}
+
+		outputFile, err := os.Create(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create file: %v\n", err)
+			os.Exit(2)
+		}
+		defer outputFile.Close()
+
+		writer := bufio.NewWriter(outputFile)
+		var conversion *ctrsigcheck.Conversion
+		if fromCCI {
+			conversion, err = ctrsigcheck.ConvertCCIToCIA(file, info.Size(), writer)
+		} else {
+			conversion, err = ctrsigcheck.ConvertCIAToCCI(file, info.Size(), writer)
+		}
+		if err != nil {
+			exitInvalid(&filename, err)
+		}
+
+		err = writer.Flush()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write file: %v\n", err)
+			os.Exit(2)
+		}
+
+		result := convertedFile{
+			File:     output,
+			NotLegit: conversion.NotLegit,
+		}
+
+		_, err = outputFile.Seek(0, io.SeekStart)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read file: %v\n", err)
+			os.Exit(2)
+		}
+
+		outputInfo, err := outputFile.Stat()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to stat file: %v\n", err)
+			os.Exit(2)
+		}
+
+		if fromCCI {
+			result.CIA, err = ctrsigcheck.CheckCIAWithOptions(outputFile, options())
+		} else {
+			result.CCI, err = ctrsigcheck.CheckCCI(outputFile, outputInfo.Size(), options())
+		}
+		if err != nil {
+			exitInvalid(&output, err)
+		}
+
+		newEncoder(os.Stdout).Encode(result)
+	},
+}
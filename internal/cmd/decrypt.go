@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	decryptCmd.Flags().AddFlagSet(&processFlags)
+	decryptCmd.Flags().AddFlagSet(&optionsFlags)
+	rootCmd.AddCommand(decryptCmd)
+}
+
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt <file> <output>",
+	Short: "Decrypt a CIA file",
+	Long: "Check a CIA file, write a copy without title key and NCCH encryption, then check the " +
+		"result as the cia command would. Since decrypted NCCH contents no longer match their " +
+		"original hashes, content hashes are not checked in the result.",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename, output := args[0], args[1]
+		transformCIA(filename, output, options(), ctrsigcheck.DecryptCIA)
+
+		checkOptions := *options()
+		checkOptions.SkipContentHashes = true
+		checkCIAOutput(output, &checkOptions)
+	},
+}
+
+// transformCIA checks the given CIA file with the given options, and writes its transformed copy
+// to output.
+func transformCIA(filename, output string, checkOptions *ctrsigcheck.Options, transform func(r io.ReaderAt, size int64, w io.Writer) error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open file: %v\n", err)
+		os.Exit(2)
+	}
+	defer file.Close()
+
+	_, err = ctrsigcheck.CheckCIAWithOptions(file, checkOptions)
+	if err != nil {
+		exitInvalid(&filename, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to stat file: %v\n", err)
+		os.Exit(2)
+	}
+
+	outputFile, err := os.Create(output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create file: %v\n", err)
+		os.Exit(2)
+	}
+	defer outputFile.Close()
+
+	writer := bufio.NewWriter(outputFile)
+	err = transform(file, info.Size(), writer)
+	if err != nil {
+		exitInvalid(&filename, err)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write file: %v\n", err)
+		os.Exit(2)
+	}
+}
+
+// checkCIAOutput checks the given CIA file with the given options, and prints the result.
+func checkCIAOutput(filename string, options *ctrsigcheck.Options) {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open file: %v\n", err)
+		os.Exit(2)
+	}
+	defer file.Close()
+
+	cia, err := ctrsigcheck.CheckCIAWithOptions(file, options)
+	if err != nil {
+		exitInvalid(&filename, err)
+	}
+
+	newEncoder(os.Stdout).Encode(ciaFile{
+		File: &filename,
+		CIA:  cia,
+	})
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"io"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+var (
+	encryptFixedKey     *bool
+	encryptCryptoMethod *uint8
+	encryptSeed         *bool
+)
+
+func init() {
+	encryptCmd.Flags().AddFlagSet(&processFlags)
+	encryptCmd.Flags().AddFlagSet(&optionsFlags)
+	encryptFixedKey = encryptCmd.Flags().Bool("fixed-key", false, "encrypt NCCH contents with a fixed key instead of trying standard encryptions")
+	encryptCryptoMethod = encryptCmd.Flags().Uint8("crypto-method", 0, "encrypt NCCH contents with the given crypto method instead of trying standard encryptions")
+	encryptSeed = encryptCmd.Flags().Bool("seed", false, "encrypt NCCH contents with seed crypto instead of trying standard encryptions")
+	rootCmd.AddCommand(encryptCmd)
+}
+
+var encryptCmd = &cobra.Command{
+	Use:   "encrypt <file> <output>",
+	Short: "Re-encrypt a decrypted CIA file",
+	Long: "Check a decrypted CIA file, write a copy with title key and NCCH encryption restored, then " +
+		"check the result as the cia command would. Each content must match its original hash once " +
+		"encrypted.",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename, output := args[0], args[1]
+
+		encryptOptions := &ctrsigcheck.EncryptOptions{}
+		if cmd.Flags().Changed("fixed-key") || cmd.Flags().Changed("crypto-method") || cmd.Flags().Changed("seed") {
+			encryptOptions.NCCHCrypto = []ctrsigcheck.NCCHCrypto{{
+				FixedKey: *encryptFixedKey,
+				Method:   *encryptCryptoMethod,
+				Seed:     *encryptSeed,
+			}}
+		}
+
+		// Decrypted contents are not expected to match their hashes yet.
+		checkOptions := *options()
+		checkOptions.SkipContentHashes = true
+		transformCIA(filename, output, &checkOptions, func(r io.ReaderAt, size int64, w io.Writer) error {
+			return ctrsigcheck.EncryptCIA(r, size, w, encryptOptions)
+		})
+
+		checkCIAOutput(output, options())
+	},
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/connesc/ctrsigcheck"
+)
+
+type errorObject struct {
+	Kind    string
+	Message string
+	Details error `json:",omitempty"`
+}
+
+func describeError(err error) *errorObject {
+	var (
+		hashMismatch       *ctrsigcheck.HashMismatchError
+		unexpectedIssuer   *ctrsigcheck.UnexpectedIssuerError
+		missingContent     *ctrsigcheck.MissingContentError
+		extraneousData     *ctrsigcheck.ExtraneousDataError
+		unsupportedVersion *ctrsigcheck.UnsupportedVersionError
+		missingKey         *ctrsigcheck.MissingKeyError
+		romfsHash          *ctrsigcheck.RomFSHashError
+	)
+
+	object := &errorObject{
+		Kind:    "Other",
+		Message: err.Error(),
+	}
+
+	switch {
+	case errors.As(err, &hashMismatch):
+		object.Kind = "HashMismatch"
+		object.Details = hashMismatch
+	case errors.As(err, &unexpectedIssuer):
+		object.Kind = "UnexpectedIssuer"
+		object.Details = unexpectedIssuer
+	case errors.As(err, &missingContent):
+		object.Kind = "MissingContent"
+		object.Details = missingContent
+	case errors.As(err, &extraneousData):
+		object.Kind = "ExtraneousData"
+		object.Details = extraneousData
+	case errors.As(err, &unsupportedVersion):
+		object.Kind = "UnsupportedVersion"
+		object.Details = unsupportedVersion
+	case errors.As(err, &missingKey):
+		object.Kind = "MissingKey"
+		object.Details = missingKey
+	case errors.As(err, &romfsHash):
+		object.Kind = "RomFSHashMismatch"
+		object.Details = romfsHash
+	}
+
+	return object
+}
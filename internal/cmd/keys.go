@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+var (
+	accessDescKeyFile string
+	seedDBFiles       []string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&accessDescKeyFile, "access-desc-key", "", "public key signing ExHeader access descriptors, as PEM or raw modulus (enables NCCH signature checks)")
+	rootCmd.PersistentFlags().StringArrayVar(&seedDBFiles, "seeddb", nil, "seeddb.bin file providing the seeds of titles that use seed crypto (can be repeated)")
+	rootCmd.PersistentFlags().BytesHexVar(&ctrsigcheck.Keys.KeyX25, "keyx-25", nil, "KeyX of keyslot 0x25 as hex, used by NCCH crypto method 0x01")
+	rootCmd.PersistentFlags().BytesHexVar(&ctrsigcheck.Keys.KeyX18, "keyx-18", nil, "KeyX of keyslot 0x18 as hex, used by NCCH crypto method 0x0A")
+	rootCmd.PersistentFlags().BytesHexVar(&ctrsigcheck.Keys.KeyX1B, "keyx-1b", nil, "KeyX of keyslot 0x1B as hex, used by NCCH crypto method 0x0B")
+	rootCmd.PersistentPreRunE = loadKeys
+}
+
+// loadKeys loads the keys given on the command line into ctrsigcheck.Keys.
+func loadKeys(cmd *cobra.Command, args []string) error {
+	// Invalid keys are not usage errors, and are reported by Execute.
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+
+	if accessDescKeyFile != "" {
+		key, err := readPublicKey(accessDescKeyFile)
+		if err != nil {
+			return fmt.Errorf("invalid access descriptor key: %w", err)
+		}
+		ctrsigcheck.Keys.AccessDesc = key
+	}
+
+	for name, keyX := range map[string][]byte{
+		"keyx-25": ctrsigcheck.Keys.KeyX25,
+		"keyx-18": ctrsigcheck.Keys.KeyX18,
+		"keyx-1b": ctrsigcheck.Keys.KeyX1B,
+	} {
+		if keyX != nil && len(keyX) != 0x10 {
+			return fmt.Errorf("invalid %s: must have length %d, got %d", name, 0x10, len(keyX))
+		}
+	}
+
+	for _, filename := range seedDBFiles {
+		err := mergeSeedDB(filename)
+		if err != nil {
+			return fmt.Errorf("invalid seeddb %s: %w", filename, err)
+		}
+	}
+
+	return nil
+}
+
+// mergeSeedDB merges the given seeddb.bin file into ctrsigcheck.Keys.Seeds.
+func mergeSeedDB(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	db, err := ctrsigcheck.ParseSeedDB(file)
+	if err != nil {
+		return err
+	}
+
+	if ctrsigcheck.Keys.Seeds == nil {
+		ctrsigcheck.Keys.Seeds = make(ctrsigcheck.SeedDB)
+	}
+	return ctrsigcheck.Keys.Seeds.Merge(db)
+}
+
+// readPublicKey reads an RSA-2048 public key, either PEM-encoded or as a raw big-endian modulus
+// with the usual exponent.
+func readPublicKey(filename string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		if len(data) != 0x100 {
+			return nil, fmt.Errorf("raw modulus must have length %d, got %d", 0x100, len(data))
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(data),
+			E: 0x10001,
+		}, nil
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("not an RSA public key")
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block type: %s", block.Type)
+	}
+}
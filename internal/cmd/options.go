@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/pflag"
+)
+
+var (
+	optionsFlags         pflag.FlagSet
+	allowExtraneousData  = optionsFlags.Bool("allow-extraneous-data", false, "tolerate unexpected data at the end of files")
+	allowMissingContents = optionsFlags.Bool("allow-missing-contents", false, "tolerate missing contents, even if they are not optional")
+	skipContentHashes    = optionsFlags.Bool("skip-content-hashes", false, "do not verify content hashes")
+	skipNCCH             = optionsFlags.Bool("skip-ncch", false, "do not parse contents as NCCH")
+	skipExeFS            = optionsFlags.Bool("skip-exefs", false, "do not parse the ExeFS of NCCH contents")
+	skipRomFS            = optionsFlags.Bool("skip-romfs", false, "do not verify the hash tree of the RomFS of NCCH contents")
+	skipSMDH             = optionsFlags.Bool("skip-smdh", false, "do not parse the icon of ExeFS files")
+	requireLegit         = optionsFlags.Bool("require-legit", false, "reject files whose Nintendo signatures are not valid")
+	requireKeys          = optionsFlags.Bool("require-keys", false, "reject encrypted NCCH data whose key is not known, instead of leaving it unverified")
+)
+
+func options() *ctrsigcheck.Options {
+	return &ctrsigcheck.Options{
+		AllowExtraneousData:  *allowExtraneousData,
+		AllowMissingContents: *allowMissingContents,
+		SkipContentHashes:    *skipContentHashes,
+		SkipNCCH:             *skipNCCH,
+		SkipExeFS:            *skipExeFS,
+		SkipRomFS:            *skipRomFS,
+		SkipSMDH:             *skipSMDH,
+		RequireLegit:         *requireLegit,
+		RequireKeys:          *requireKeys,
+	}
+}
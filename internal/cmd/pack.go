@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+var packMeta *bool
+
+func init() {
+	packMeta = packCmd.Flags().BoolP("meta", "m", false, "generate a meta section from the icon of the first content")
+	packCmd.Flags().AddFlagSet(&processFlags)
+	packCmd.Flags().AddFlagSet(&optionsFlags)
+	rootCmd.AddCommand(packCmd)
+}
+
+var packCmd = &cobra.Command{
+	Use:   "pack <dir> <output>",
+	Short: "Build a CIA file from CDN files",
+	Long: "Build a CIA file from a directory containing CDN files (tmd, cetk and content files named " +
+		"after their 8-hex-digit ID), then check the result as the cia command would",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, output := args[0], args[1]
+
+		ticket, err := ioutil.ReadFile(filepath.Join(dir, "cetk"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read ticket: %v\n", err)
+			os.Exit(2)
+		}
+		tmd, err := ioutil.ReadFile(filepath.Join(dir, "tmd"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read TMD: %v\n", err)
+			os.Exit(2)
+		}
+
+		parsedTMD, err := ctrsigcheck.CheckTMD(bytes.NewReader(tmd))
+		if err != nil {
+			exitInvalid(&dir, err)
+		}
+
+		// Optional contents are omitted when missing from the directory.
+		writerOptions := &ctrsigcheck.CIAWriterOptions{Meta: *packMeta}
+		for _, content := range parsedTMD.Contents {
+			if content.Optional && contentPath(dir, content.ID) == "" {
+				writerOptions.OmitContents = append(writerOptions.OmitContents, content.ID)
+			}
+		}
+
+		file, err := os.Create(output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create file: %v\n", err)
+			os.Exit(2)
+		}
+		defer file.Close()
+
+		writer, err := ctrsigcheck.NewCIAWriter(file, ticket, tmd, writerOptions)
+		if err != nil {
+			exitInvalid(&dir, err)
+		}
+
+		for content := writer.NextContent(); content != nil; content = writer.NextContent() {
+			path := contentPath(dir, content.ID)
+			if path == "" {
+				fmt.Fprintf(os.Stderr, "Unable to find content %s\n", content.ID)
+				os.Exit(2)
+			}
+			err = writeContentFile(writer, path)
+			if err != nil {
+				exitInvalid(&dir, err)
+			}
+		}
+
+		err = writer.Close()
+		if err != nil {
+			exitInvalid(&dir, err)
+		}
+
+		processFiles([]string{output}, checkCIAFile)
+	},
+}
+
+// contentPath returns the path of the given content in a CDN directory, or an empty string if it
+// cannot be found. Both lowercase and uppercase file names are accepted.
+func contentPath(dir string, id ctrsigcheck.Hex32) string {
+	name := fmt.Sprintf("%08x", uint32(id))
+	for _, candidate := range []string{name, strings.ToUpper(name)} {
+		path := filepath.Join(dir, candidate)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+func writeContentFile(writer *ctrsigcheck.CIAWriter, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open file: %v\n", err)
+		os.Exit(2)
+	}
+	defer file.Close()
+
+	return writer.WriteContent(file)
+}
@@ -16,21 +16,46 @@ var (
 	compact      = processFlags.BoolP("compact", "c", false, "disable pretty-printing of JSON output")
 )
 
-func processFiles(filenames []string, process processFunc) {
-	encoder := json.NewEncoder(os.Stdout)
+// failed is set by a processFunc to exit with an error once all files have been processed.
+var failed bool
+
+type invalidFile struct {
+	File  *string
+	Error *errorObject
+}
+
+func newEncoder(w io.Writer) *json.Encoder {
+	encoder := json.NewEncoder(w)
 	if !*compact {
 		encoder.SetIndent("", "  ")
 	}
 	encoder.SetEscapeHTML(false)
+	return encoder
+}
 
-	if len(os.Args) <= 1 {
+// exitInvalid describes the given error as a JSON object on stderr, and exits.
+func exitInvalid(filename *string, err error) {
+	newEncoder(os.Stderr).Encode(invalidFile{
+		File:  filename,
+		Error: describeError(err),
+	})
+	os.Exit(3)
+}
+
+func processFiles(filenames []string, process processFunc) {
+	encoder := newEncoder(os.Stdout)
+
+	if len(filenames) == 0 {
 		encoder.Encode(process(nil, os.Stdin))
-		return
 	}
 
 	for _, filename := range filenames {
 		processFile(filename, process, encoder)
 	}
+
+	if failed {
+		os.Exit(3)
+	}
 }
 
 func processFile(filename string, process processFunc, encoder *json.Encoder) {
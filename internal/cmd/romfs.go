@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	romfsFlags   pflag.FlagSet
+	romfsContent = romfsFlags.IntP("content", "i", 0, "position of the content to read in the TMD, for CIA files")
+
+	romfsRecursive *bool
+	romfsOutput    *string
+)
+
+func init() {
+	romfsLsCmd.Flags().AddFlagSet(&romfsFlags)
+	romfsLsCmd.Flags().AddFlagSet(&processFlags)
+	romfsRecursive = romfsLsCmd.Flags().BoolP("recursive", "r", false, "list subdirectories recursively")
+	romfsCatCmd.Flags().AddFlagSet(&romfsFlags)
+	romfsExtractCmd.Flags().AddFlagSet(&romfsFlags)
+	romfsOutput = romfsExtractCmd.Flags().StringP("output", "o", ".", "directory in which files are extracted")
+
+	romfsCmd.AddCommand(romfsLsCmd, romfsCatCmd, romfsExtractCmd)
+	rootCmd.AddCommand(romfsCmd)
+}
+
+type romfsEntry struct {
+	Path string
+	Dir  bool
+	Size int64 `json:",omitempty"`
+}
+
+var romfsCmd = &cobra.Command{
+	Use:   "romfs",
+	Short: "Read the RomFS of CIA contents, CXI and CFA files",
+	Long: "Read the file system stored in the RomFS of an NCCH, given either as a CXI or CFA file, or " +
+		"as a content of a CIA file. The RomFS is decrypted on the fly, but its hashes are not " +
+		"checked. Paths are relative to the root of the RomFS, with or without a leading slash.",
+}
+
+var romfsLsCmd = &cobra.Command{
+	Use:   "ls <file> [path]",
+	Short: "List the entries of a RomFS directory",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename, name := args[0], romfsPath(args)
+		romfs, file := openRomFS(filename)
+		defer file.Close()
+
+		entries := make([]romfsEntry, 0)
+		err := fs.WalkDir(romfs, name, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if p == name && d.IsDir() {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			entries = append(entries, romfsEntry{
+				Path: "/" + p,
+				Dir:  d.IsDir(),
+				Size: info.Size(),
+			})
+
+			if d.IsDir() && !*romfsRecursive {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			exitInvalid(&filename, err)
+		}
+
+		newEncoder(os.Stdout).Encode(entries)
+	},
+}
+
+var romfsCatCmd = &cobra.Command{
+	Use:   "cat <file> <path>",
+	Short: "Write a RomFS file to the standard output",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename, name := args[0], romfsPath(args)
+		romfs, file := openRomFS(filename)
+		defer file.Close()
+
+		data, err := romfs.Open(name)
+		if err != nil {
+			exitInvalid(&filename, err)
+		}
+		defer data.Close()
+
+		_, err = io.Copy(os.Stdout, data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write file: %v\n", err)
+			os.Exit(2)
+		}
+	},
+}
+
+var romfsExtractCmd = &cobra.Command{
+	Use:   "extract <file> [path]",
+	Short: "Extract RomFS files into a directory",
+	Long: "Extract the given RomFS file or directory (the whole RomFS by default) into the output " +
+		"directory, preserving paths relative to the root of the RomFS",
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename, name := args[0], romfsPath(args)
+		romfs, file := openRomFS(filename)
+		defer file.Close()
+
+		err := fs.WalkDir(romfs, name, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			output := filepath.Join(*romfsOutput, filepath.FromSlash(p))
+			rel, err := filepath.Rel(*romfsOutput, output)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("romfs: path escapes the output directory: %s", p)
+			}
+
+			if d.IsDir() {
+				err = os.MkdirAll(output, 0777)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to create directory: %v\n", err)
+					os.Exit(2)
+				}
+				return nil
+			}
+
+			return extractRomFSFile(romfs, p, output)
+		})
+		if err != nil {
+			exitInvalid(&filename, err)
+		}
+	},
+}
+
+// romfsPath returns the RomFS path given as second argument, as expected by fs.FS.
+func romfsPath(args []string) string {
+	if len(args) < 2 {
+		return "."
+	}
+	name := path.Clean("/" + args[1])
+	if name == "/" {
+		return "."
+	}
+	return strings.TrimPrefix(name, "/")
+}
+
+// openRomFS opens the RomFS of the given CIA, CXI or CFA file, and exits on failure. The returned
+// file must be closed by the caller.
+func openRomFS(filename string) (*ctrsigcheck.RomFS, *os.File) {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open file: %v\n", err)
+		os.Exit(2)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to stat file: %v\n", err)
+		os.Exit(2)
+	}
+
+	var ncch io.ReaderAt = file
+	size := info.Size()
+
+	magic := make([]byte, 4)
+	_, err = file.ReadAt(magic, 0x100)
+	if err != nil || !bytes.Equal(magic, []byte("NCCH")) {
+		cia, err := ctrsigcheck.OpenCIA(file, size)
+		if err != nil {
+			exitInvalid(&filename, err)
+		}
+		content, err := cia.DecryptedContentReader(*romfsContent)
+		if err != nil {
+			exitInvalid(&filename, err)
+		}
+		ncch, size = content, content.Size()
+	}
+
+	romfs, err := ctrsigcheck.OpenNCCHRomFS(ncch, size)
+	if err != nil {
+		exitInvalid(&filename, err)
+	}
+
+	return romfs, file
+}
+
+// extractRomFSFile copies the given RomFS file to output.
+func extractRomFSFile(romfs *ctrsigcheck.RomFS, name, output string) error {
+	data, err := romfs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	err = os.MkdirAll(filepath.Dir(output), 0777)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create directory: %v\n", err)
+		os.Exit(2)
+	}
+
+	outputFile, err := os.Create(output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create file: %v\n", err)
+		os.Exit(2)
+	}
+	defer outputFile.Close()
+
+	_, err = io.Copy(outputFile, data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write file: %v\n", err)
+		os.Exit(2)
+	}
+
+	return nil
+}
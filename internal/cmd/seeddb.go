@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+var seedDBOutput *string
+
+func init() {
+	seedDBCmd.Flags().AddFlagSet(&processFlags)
+	seedDBOutput = seedDBCmd.Flags().StringP("output", "o", "", "write the merged entries to the given seeddb.bin file")
+	rootCmd.AddCommand(seedDBCmd)
+}
+
+var seedDBCmd = &cobra.Command{
+	Use:   "seeddb [file...]",
+	Short: "Merge and list seeddb.bin files",
+	Long: "Merge the seeddb.bin files given as arguments with those loaded by the --seeddb flag, " +
+		"and print the resulting seeds by title ID. The same title may appear in several files, " +
+		"but only with the same seed.",
+	Run: func(cmd *cobra.Command, args []string) {
+		for i := range args {
+			err := mergeSeedDB(args[i])
+			if err != nil {
+				exitInvalid(&args[i], err)
+			}
+		}
+
+		seeds := ctrsigcheck.Keys.Seeds
+		if seeds == nil {
+			seeds = make(ctrsigcheck.SeedDB)
+		}
+
+		if *seedDBOutput != "" {
+			writeSeedDB(*seedDBOutput, seeds)
+		}
+
+		newEncoder(os.Stdout).Encode(seeds)
+	},
+}
+
+// writeSeedDB writes the given seeds to a seeddb.bin file.
+func writeSeedDB(filename string, seeds ctrsigcheck.SeedDB) {
+	file, err := os.Create(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create file: %v\n", err)
+		os.Exit(2)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	_, err = seeds.WriteTo(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write file: %v\n", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/connesc/ctrsigcheck"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	splitCmd.Flags().AddFlagSet(&processFlags)
+	splitCmd.Flags().AddFlagSet(&optionsFlags)
+	rootCmd.AddCommand(splitCmd)
+}
+
+var splitCmd = &cobra.Command{
+	Use:   "split <file> <dir>",
+	Short: "Split a CIA file into CDN files",
+	Long: "Check a CIA file, write its sections into a directory using the layout of Nintendo's CDN " +
+		"(cetk, tmd and content files named after their 8-hex-digit ID), then check the result as " +
+		"the cdn command would",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename, dir := args[0], args[1]
+
+		file, err := os.Open(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to open file: %v\n", err)
+			os.Exit(2)
+		}
+		defer file.Close()
+
+		_, err = ctrsigcheck.CheckCIAWithOptions(file, options())
+		if err != nil {
+			exitInvalid(&filename, err)
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to stat file: %v\n", err)
+			os.Exit(2)
+		}
+
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create directory: %v\n", err)
+			os.Exit(2)
+		}
+
+		err = ctrsigcheck.SplitCIA(file, info.Size(), dir)
+		if err != nil {
+			exitInvalid(&filename, err)
+		}
+
+		cdn, err := ctrsigcheck.CheckCDN(dir, options())
+		if err != nil {
+			exitInvalid(&dir, err)
+		}
+
+		newEncoder(os.Stdout).Encode(cdnDir{
+			Dir: dir,
+			CDN: cdn,
+		})
+	},
+}
@@ -1,9 +1,7 @@
 package cmd
 
 import (
-	"fmt"
 	"io"
-	"os"
 
 	"github.com/connesc/ctrsigcheck"
 	"github.com/spf13/cobra"
@@ -11,6 +9,7 @@ import (
 
 func init() {
 	ticketCmd.Flags().AddFlagSet(&processFlags)
+	ticketCmd.Flags().AddFlagSet(&optionsFlags)
 	rootCmd.AddCommand(ticketCmd)
 }
 
@@ -25,10 +24,9 @@ var ticketCmd = &cobra.Command{
 	Long:  "Check ticket files given as arguments, or stdin if none is given",
 	Run: func(cmd *cobra.Command, args []string) {
 		processFiles(args, func(filename *string, input io.Reader) interface{} {
-			ticket, err := ctrsigcheck.CheckTicket(input)
+			ticket, err := ctrsigcheck.CheckTicketWithOptions(input, options())
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Invalid ticket: %v\n", err)
-				os.Exit(3)
+				exitInvalid(filename, err)
 			}
 			return ticketFile{
 				File:   filename,
@@ -1,16 +1,22 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/connesc/ctrsigcheck"
 	"github.com/spf13/cobra"
 )
 
+var restoreTMD *bool
+
 func init() {
 	tmdCmd.Flags().AddFlagSet(&processFlags)
+	tmdCmd.Flags().AddFlagSet(&optionsFlags)
+	restoreTMD = tmdCmd.Flags().Bool("restore", false, "rewrite files in place with their original TMD, when modified on decryption")
 	rootCmd.AddCommand(tmdCmd)
 }
 
@@ -25,10 +31,13 @@ var tmdCmd = &cobra.Command{
 	Long:  "Check TMD files given as arguments, or stdin if none is given",
 	Run: func(cmd *cobra.Command, args []string) {
 		processFiles(args, func(filename *string, input io.Reader) interface{} {
-			tmd, err := ctrsigcheck.CheckTMD(input)
+			if *restoreTMD {
+				input = restoreTMDFile(filename, input)
+			}
+
+			tmd, err := ctrsigcheck.CheckTMDWithOptions(input, options())
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Invalid TMD: %v\n", err)
-				os.Exit(3)
+				exitInvalid(filename, err)
 			}
 			return tmdFile{
 				File: filename,
@@ -37,3 +46,33 @@ var tmdCmd = &cobra.Command{
 		})
 	},
 }
+
+// restoreTMDFile rewrites the given TMD file with its original form, and returns the result. The
+// file is left untouched if its TMD is already original.
+func restoreTMDFile(filename *string, input io.Reader) io.Reader {
+	if filename == nil {
+		fmt.Fprintln(os.Stderr, "Unable to restore TMD from stdin")
+		os.Exit(2)
+	}
+
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read file: %v\n", err)
+		os.Exit(2)
+	}
+
+	original, err := ctrsigcheck.RestoreTMDWithOptions(bytes.NewReader(data), options())
+	if err != nil {
+		exitInvalid(filename, err)
+	}
+
+	if !bytes.Equal(original, data) {
+		err = ioutil.WriteFile(*filename, original, 0666)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write file: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	return bytes.NewReader(original)
+}
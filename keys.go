@@ -1,9 +1,30 @@
 package ctrsigcheck
 
 import (
+	"crypto/rsa"
 	"math/big"
 )
 
+// Keys contains the keys that are not embedded in this package. They must be provided by the
+// caller to enable the corresponding features.
+var Keys struct {
+	// AccessDesc is the retail public key that signs the access descriptors of ExHeaders. It is
+	// needed to verify NCCH signatures (see NCCH.Legit).
+	AccessDesc *rsa.PublicKey
+
+	// Seeds provides the seeds of titles whose NCCHs use seed crypto. They are needed to decrypt
+	// the RomFS and most ExeFS files of such NCCHs, and are checked against the seed hash of
+	// their headers.
+	Seeds SeedDB
+
+	// KeyX25, KeyX18 and KeyX1B are the KeyX values of the keyslots 0x25, 0x18 and 0x1B. They
+	// are selected by the NCCH crypto methods 0x01 (7.x), 0x0A (New 3DS 9.3) and 0x0B (New 3DS
+	// 9.6), and are needed to decrypt the RomFS and most ExeFS files of such NCCHs.
+	KeyX25 []byte
+	KeyX18 []byte
+	KeyX1B []byte
+}
+
 var commonKeys = [...][]byte{
 	{0x64, 0xc5, 0xfd, 0x55, 0xdd, 0x3a, 0xd9, 0x88, 0x32, 0x5b, 0xaa, 0xec, 0x52, 0x43, 0xdb, 0x98},
 	{0x4a, 0xaa, 0x3d, 0x0e, 0x27, 0xd4, 0xd7, 0x28, 0xd0, 0xb1, 0xb4, 0x33, 0xf0, 0xf9, 0xcb, 0xc8},
@@ -1,37 +1,134 @@
 package ctrsigcheck
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rsa"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
+	"sort"
 
 	"github.com/connesc/ctrsigcheck/ctrutil"
 )
 
 // NCCH describes the result of NCCH parsing.
+//
+// Legit is only set by CheckNCCH, since the signature of the header only guarantees the content of
+// the NCCH once its hashes are verified. Unverified lists the parts that could not be verified
+// because their key is missing, unless Options.RequireKeys is set: Legit is never set if any.
 type NCCH struct {
+	Legit       bool
 	PartitionID Hex64
 	ProgramID   Hex64
 	Encrypted   bool
+	ExHeader    *ExHeader
 	ExeFS       *ExeFS
+	Unverified  []string
+}
+
+// ncchSection describes a region of an NCCH, as declared in its header.
+type ncchSection struct {
+	name   string
+	offset int64
+	size   int64
+
+	// Description, size and location in the header of the hash covering the beginning of the
+	// region. The hash size is zero if the region is not hashed.
+	hashSubject string
+	hashSize    int64
+	hashOffset  int
+}
+
+// ncchSections returns the regions declared in the given NCCH header, sorted by offset. Empty
+// regions are omitted.
+func ncchSections(header []byte) []ncchSection {
+	mediaUnit := ncchMediaUnit(header)
+	units := func(offset int) int64 {
+		return int64(binary.LittleEndian.Uint32(header[offset:])) * mediaUnit
+	}
+
+	exheaderSize := int64(binary.LittleEndian.Uint32(header[0x180:]))
+	exheaderRegionSize := int64(0)
+	if exheaderSize > 0 {
+		exheaderRegionSize = 0x800
+	}
+
+	sections := []ncchSection{
+		{"ExHeader", 0x200, exheaderRegionSize, "ExHeader", exheaderSize, 0x160},
+		{"logo", units(0x198), units(0x19c), "logo", units(0x19c), 0x130},
+		{"plain region", units(0x190), units(0x194), "", 0, 0},
+		{"ExeFS", units(0x1a0), units(0x1a4), "ExeFS superblock", units(0x1a8), 0x1c0},
+		{"RomFS", units(0x1b0), units(0x1b4), "RomFS superblock", units(0x1b8), 0x1e0},
+	}
+
+	nonEmpty := make([]ncchSection, 0, len(sections))
+	for _, section := range sections {
+		if section.size > 0 {
+			nonEmpty = append(nonEmpty, section)
+		}
+	}
+	sort.SliceStable(nonEmpty, func(i, j int) bool { return nonEmpty[i].offset < nonEmpty[j].offset })
+
+	return nonEmpty
 }
 
 // ParseNCCH extracts some information from the given NCCH file.
 //
 // No integrity checks are performed.
 func ParseNCCH(input io.Reader) (*NCCH, error) {
+	return ParseNCCHWithOptions(input, nil)
+}
+
+// ParseNCCHWithOptions is like ParseNCCH, but its behavior can be adjusted with the given options.
+// A nil options is equivalent to the zero value.
+func ParseNCCHWithOptions(input io.Reader, options *Options) (*NCCH, error) {
+	return readNCCH(input, 0, options.orDefault(), false)
+}
+
+// CheckNCCH reads the given NCCH file and verifies its integrity.
+//
+// The size must match the content size declared in the header, and every region must fit in it
+// without overlapping the others. The hashes of the ExHeader, the logo, and the superblocks of the
+// ExeFS and the RomFS are verified against the header, after decryption if needed. The ExeFS and
+// the RomFS are then verified as well (see CheckExeFS and CheckRomFS).
+//
+// Verifying encrypted data requires the appropriate keys, which may not be known. Such data is
+// listed in Unverified, or rejected with a MissingKeyError if Options.RequireKeys is set. NCCHs
+// that use seed crypto also need the seed of their title, which is looked up in Keys.Seeds and
+// checked against the seed hash of the header.
+//
+// An NCCH is considered "legit" if its header is signed by the key found in the access descriptor
+// of its ExHeader, and if this access descriptor is itself signed by Nintendo. Since the key of
+// Nintendo is not embedded, it must be provided through Keys.AccessDesc. Only programs (CXI) have
+// an ExHeader: other NCCH files (CFA) are never considered "legit", and neither are NCCHs with
+// unverified parts.
+//
+// The NCCH is read sequentially, but only up to the last verified part: the caller is
+// responsible for consuming the rest.
+func CheckNCCH(input io.Reader, size int64) (*NCCH, error) {
+	return CheckNCCHWithOptions(input, size, nil)
+}
+
+// CheckNCCHWithOptions is like CheckNCCH, but its behavior can be adjusted with the given options.
+// A nil options is equivalent to the zero value.
+func CheckNCCHWithOptions(input io.Reader, size int64, options *Options) (*NCCH, error) {
+	return readNCCH(input, size, options.orDefault(), true)
+}
+
+func readNCCH(input io.Reader, size int64, options *Options, verify bool) (*NCCH, error) {
 	reader := ctrutil.NewReader(input)
 
-	header := make([]byte, 0x1e0)
+	header := make([]byte, 0x200)
 	_, err := io.ReadFull(reader, header)
 	if err != nil {
 		return nil, fmt.Errorf("ncch: failed to read header: %w", err)
 	}
 
-	signature := header[:0x100]
-
 	if string(header[0x100:0x104]) != "NCCH" {
 		return nil, fmt.Errorf("ncch: magic not found")
 	}
@@ -41,64 +138,248 @@ func ParseNCCH(input io.Reader) (*NCCH, error) {
 
 	version := binary.LittleEndian.Uint16(header[0x112:])
 	if version >= 3 {
-		return nil, fmt.Errorf("ncch: version must be less than 3: %d", version)
+		return nil, &UnsupportedVersionError{
+			Location: Location{Structure: "ncch", Offset: 0x112},
+			Version:  uint(version),
+		}
 	}
 
 	flags := header[0x188:0x190]
-	encrypted := flags[7]&0x4 == 0
+	encrypted := flags[7]&ncchNoCrypto == 0
 
-	exefsOffset := int64(binary.LittleEndian.Uint32(header[0x1a0:])) * 0x200
-	exefsSize := int64(binary.LittleEndian.Uint32(header[0x1a4:])) * 0x200
+	sections := ncchSections(header)
 
-	var exefs *ExeFS
+	if verify {
+		contentSize := int64(binary.LittleEndian.Uint32(header[0x104:])) * ncchMediaUnit(header)
+		if contentSize != size {
+			return nil, fmt.Errorf("ncch: content size does not match actual size: %d != %d", contentSize, size)
+		}
 
-	if exefsSize > 0 {
-		err = reader.Discard(int64(exefsOffset) - reader.Offset())
+		end := int64(0x200)
+		for _, section := range sections {
+			if section.offset < end {
+				return nil, fmt.Errorf("ncch: %s overlaps previous data", section.name)
+			}
+			if section.offset+section.size > contentSize {
+				return nil, fmt.Errorf("ncch: %s exceeds content size", section.name)
+			}
+			if section.hashSize > section.size {
+				return nil, fmt.Errorf("ncch: hashed part of %s exceeds its size: %d > %d", section.name, section.hashSize, section.size)
+			}
+			end = section.offset + section.size
+		}
+	}
+
+	ncch := &NCCH{
+		PartitionID: Hex64(partitionID),
+		ProgramID:   Hex64(programID),
+		Encrypted:   encrypted,
+		Unverified:  make([]string, 0),
+	}
+
+	for _, section := range sections {
+		parse := section.name == "ExHeader" || section.name == "ExeFS" && !options.SkipExeFS
+		if !parse && (!verify || section.hashSize == 0) {
+			continue
+		}
+
+		if reader.Offset() > section.offset {
+			return nil, fmt.Errorf("ncch: %s overlaps previous data", section.name)
+		}
+		err = reader.Discard(section.offset - reader.Offset())
 		if err != nil {
-			return nil, fmt.Errorf("ncch: failed to jump to ExeFS: %w", err)
+			return nil, fmt.Errorf("ncch: failed to jump to %s: %w", section.name, err)
 		}
 
-		data := io.LimitReader(reader, exefsSize)
+		data := io.LimitReader(reader, section.size)
+		switch section.name {
+		case "ExHeader":
+			ncch.ExHeader, err = checkNCCHExHeader(data, header, section, verify)
+		case "ExeFS":
+			ncch.ExeFS, err = checkNCCHExeFS(data, header, section, options, verify, ncch)
+		case "RomFS":
+			err = checkNCCHRomFS(data, header, section, options, ncch)
+		default:
+			_, err = checkNCCHHash(data, header, section)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		if encrypted {
-			var key []byte
-			switch {
-			case flags[7]&0x1 == 0:
-				key = keygen(ncchKeyX, signature[:0x10])
-			case partitionID&1000000000 != 0:
-				key = fixedSystemKey
-			default:
-				key = zeroKey
-			}
+	if verify {
+		ncch.Legit = len(ncch.Unverified) == 0 && verifyNCCHSignature(header, ncch.ExHeader)
+	}
+
+	return ncch, nil
+}
+
+// verifyNCCHSignature checks the signature of the given NCCH header, using the key found in the
+// access descriptor of the given ExHeader, which must itself be signed by Keys.AccessDesc.
+func verifyNCCHSignature(header []byte, exheader *ExHeader) bool {
+	if Keys.AccessDesc == nil || exheader == nil {
+		return false
+	}
+
+	accessDesc := exheader.raw[0x400:0x800]
+	if rsa.VerifyPKCS1v15(Keys.AccessDesc, crypto.SHA256, sha256Hash(accessDesc[0x100:]), accessDesc[:0x100]) != nil {
+		return false
+	}
+
+	ncchKey := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(accessDesc[0x100:0x200]),
+		E: 0x10001,
+	}
+	return rsa.VerifyPKCS1v15(ncchKey, crypto.SHA256, sha256Hash(header[0x100:]), header[:0x100]) == nil
+}
+
+// checkNCCHExHeader parses the ExHeader read from data, after verifying its hash if verify is
+// true. The ExHeader is encrypted with the primary key.
+func checkNCCHExHeader(data io.Reader, header []byte, section ncchSection, verify bool) (*ExHeader, error) {
+	if header[0x18f]&ncchNoCrypto == 0 {
+		block, err := aes.NewCipher(ncchPrimaryKey(header))
+		if err != nil {
+			return nil, fmt.Errorf("ncch: failed to initialize ExHeader cipher: %w", err)
+		}
+		data = cipher.StreamReader{
+			S: cipher.NewCTR(block, ncchIV(header, ncchExHeader, section.offset)),
+			R: data,
+		}
+	}
+
+	raw := make([]byte, section.size)
+	_, err := io.ReadFull(data, raw)
+	if err != nil {
+		return nil, fmt.Errorf("ncch: failed to read ExHeader: %w", err)
+	}
+
+	if verify && !bytes.Equal(sha256Hash(raw[:section.hashSize]), header[section.hashOffset:section.hashOffset+0x20]) {
+		return nil, &HashMismatchError{
+			Location: Location{Structure: "ncch", Offset: section.offset},
+			Subject:  section.hashSubject,
+		}
+	}
+
+	return ParseExHeader(bytes.NewReader(raw))
+}
+
+// checkNCCHHash verifies the hashed part of the given region, which is read from data, and
+// returns it.
+func checkNCCHHash(data io.Reader, header []byte, section ncchSection) ([]byte, error) {
+	hashed := make([]byte, section.hashSize)
+	_, err := io.ReadFull(data, hashed)
+	if err != nil {
+		return nil, fmt.Errorf("ncch: failed to read %s: %w", section.name, err)
+	}
+
+	if !bytes.Equal(sha256Hash(hashed), header[section.hashOffset:section.hashOffset+0x20]) {
+		return nil, &HashMismatchError{
+			Location: Location{Structure: "ncch", Offset: section.offset},
+			Subject:  section.hashSubject,
+		}
+	}
+
+	return hashed, nil
+}
 
-			exefsCipher, err := aes.NewCipher(key)
+// tolerateMissingKey returns nil if err is a MissingKeyError tolerated by the given options, in
+// which case the given part is recorded as unverified. Otherwise, err is returned as is.
+func (ncch *NCCH) tolerateMissingKey(err error, part string, options *Options) error {
+	var missingKey *MissingKeyError
+	if !errors.As(err, &missingKey) || options.RequireKeys {
+		return err
+	}
+	ncch.Unverified = append(ncch.Unverified, part)
+	return nil
+}
+
+// checkNCCHRomFS verifies the superblock hash of the RomFS read from data, and then its hash tree
+// (see CheckRomFS). The RomFS is encrypted with the secondary key.
+func checkNCCHRomFS(data io.Reader, header []byte, section ncchSection, options *Options, ncch *NCCH) error {
+	if header[0x18f]&ncchNoCrypto == 0 {
+		key, err := ncchSecondaryKey(header)
+		if err != nil {
+			return ncch.tolerateMissingKey(err, "RomFS", options)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("ncch: failed to initialize RomFS cipher: %w", err)
+		}
+		data = cipher.StreamReader{
+			S: cipher.NewCTR(block, ncchIV(header, ncchRomFS, section.offset)),
+			R: data,
+		}
+	}
+
+	hashed, err := checkNCCHHash(data, header, section)
+	if err != nil || options.SkipRomFS {
+		return err
+	}
+
+	return CheckRomFS(io.MultiReader(bytes.NewReader(hashed), data), section.size)
+}
+
+// checkNCCHExeFS parses the ExeFS read from data. If verify is true, its superblock hash and the
+// hashes of its files are verified too.
+func checkNCCHExeFS(data io.Reader, header []byte, section ncchSection, options *Options, verify bool, ncch *NCCH) (*ExeFS, error) {
+	var decrypter *ncchExeFSDecrypter
+
+	if header[0x18f]&ncchNoCrypto == 0 {
+		var err error
+		decrypter, err = newNCCHExeFSDecrypter(data, header, section.offset, section.size)
+		if err != nil {
+			return nil, err
+		}
+		data = decrypter
+	}
+
+	if verify && section.hashSize > 0 {
+		hashed := make([]byte, section.hashSize)
+		_, err := io.ReadFull(data, hashed)
+		if err != nil {
+			return nil, fmt.Errorf("ncch: failed to read ExeFS: %w", err)
+		}
+
+		if decrypter != nil && decrypter.missing != nil {
+			err = ncch.tolerateMissingKey(decrypter.missing, section.hashSubject, options)
 			if err != nil {
-				return nil, fmt.Errorf("ncch: failed to initialize ExeFS cipher: %w", err)
-			}
-			exefsIV := make([]byte, exefsCipher.BlockSize())
-			if version == 1 {
-				binary.LittleEndian.PutUint64(exefsIV, partitionID)
-				binary.BigEndian.PutUint64(exefsIV, uint64(exefsOffset))
-			} else {
-				binary.BigEndian.PutUint64(exefsIV, partitionID)
-				exefsIV[8] = 2
+				return nil, err
 			}
-			data = cipher.StreamReader{
-				S: cipher.NewCTR(exefsCipher, exefsIV),
-				R: data,
+		} else if !bytes.Equal(sha256Hash(hashed), header[section.hashOffset:section.hashOffset+0x20]) {
+			return nil, &HashMismatchError{
+				Location: Location{Structure: "ncch", Offset: section.offset},
+				Subject:  section.hashSubject,
 			}
 		}
 
-		exefs, err = ParseExeFS(data)
+		data = io.MultiReader(bytes.NewReader(hashed), data)
+	}
+
+	if options.SkipExeFS {
+		return nil, nil
+	}
+
+	// Files encrypted with a missing secondary key cannot be verified.
+	skipped := make([]string, 0)
+	skipHash := func(name string) bool {
+		if decrypter == nil || decrypter.secondaryErr == nil || name == "icon" || name == "banner" {
+			return false
+		}
+		skipped = append(skipped, name)
+		return true
+	}
+
+	exefs, err := readExeFS(data, section.size, options, verify, skipHash)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range skipped {
+		err = ncch.tolerateMissingKey(decrypter.secondaryErr, fmt.Sprintf("ExeFS file %q", name), options)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return &NCCH{
-		PartitionID: Hex64(partitionID),
-		ProgramID:   Hex64(programID),
-		Encrypted:   encrypted,
-		ExeFS:       exefs,
-	}, nil
+	return exefs, nil
 }
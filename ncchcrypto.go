@@ -0,0 +1,645 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// NCCH flags involved in encryption.
+const (
+	ncchFixedKey = 0x01
+	ncchNoCrypto = 0x04
+	ncchSeed     = 0x20
+)
+
+// NCCH sections, as used in counters.
+const (
+	ncchExHeader = 1
+	ncchExeFS    = 2
+	ncchRomFS    = 3
+)
+
+func ncchMediaUnit(header []byte) int64 {
+	return 0x200 << header[0x18e]
+}
+
+// ncchPrimaryKey returns the key used for the ExHeader, the ExeFS header, and the "icon" and
+// "banner" ExeFS files.
+func ncchPrimaryKey(header []byte) []byte {
+	flags := header[0x188:0x190]
+	programID := binary.LittleEndian.Uint64(header[0x118:])
+
+	if flags[7]&ncchFixedKey != 0 {
+		// System titles have their own fixed key.
+		if programID&0x1000000000 != 0 {
+			return fixedSystemKey
+		}
+		return zeroKey
+	}
+
+	return keygen(ncchKeyX, header[:0x10])
+}
+
+// ncchSecondaryKey returns the key used for the RomFS and the other ExeFS files, according to the
+// crypto method of the NCCH.
+func ncchSecondaryKey(header []byte) ([]byte, error) {
+	flags := header[0x188:0x190]
+
+	if flags[7]&ncchFixedKey != 0 {
+		return ncchPrimaryKey(header), nil
+	}
+
+	keyX, err := ncchSecondaryKeyX(flags[3])
+	if err != nil {
+		return nil, err
+	}
+
+	keyY := header[:0x10]
+	if flags[7]&ncchSeed != 0 {
+		keyY, err = ncchSeedKeyY(header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keygen(keyX, keyY), nil
+}
+
+// ncchSecondaryKeyX returns the KeyX selected by the given crypto method. Only the KeyX of the
+// crypto method 0x00 is embedded, the others must be provided through Keys.
+func ncchSecondaryKeyX(method byte) ([]byte, error) {
+	var keyX []byte
+	var slot int
+	switch method {
+	case 0x00:
+		return ncchKeyX, nil
+	case 0x01:
+		keyX, slot = Keys.KeyX25, 0x25
+	case 0x0a:
+		keyX, slot = Keys.KeyX18, 0x18
+	case 0x0b:
+		keyX, slot = Keys.KeyX1B, 0x1b
+	default:
+		return nil, fmt.Errorf("ncch: unknown crypto method: 0x%02x", method)
+	}
+
+	if keyX == nil {
+		return nil, &MissingKeyError{
+			Location: Location{Structure: "ncch", Offset: 0x18b},
+			Key:      fmt.Sprintf("KeyX of keyslot 0x%02X for crypto method 0x%02x", slot, method),
+		}
+	}
+	if len(keyX) != 0x10 {
+		return nil, fmt.Errorf("ncch: KeyX of keyslot 0x%02X must have length %d, got %d", slot, 0x10, len(keyX))
+	}
+
+	return keyX, nil
+}
+
+// ncchSeedKeyY returns the KeyY of the secondary key of an NCCH that uses seed crypto, once its
+// seed has been checked against the seed hash of the header.
+func ncchSeedKeyY(header []byte) ([]byte, error) {
+	programID := header[0x118:0x120]
+	titleID := Hex64(binary.LittleEndian.Uint64(programID))
+
+	seed, ok := Keys.Seeds[titleID]
+	if !ok {
+		return nil, &MissingKeyError{
+			Location: Location{Structure: "ncch", Offset: 0x18f},
+			Key:      fmt.Sprintf("seed for title %s", titleID),
+		}
+	}
+	if len(seed) != 0x10 {
+		return nil, fmt.Errorf("ncch: seed for title %s must have length %d, got %d", titleID, 0x10, len(seed))
+	}
+
+	seedHash := sha256Hash(append(append([]byte(nil), seed...), programID...))
+	if !bytes.Equal(seedHash[:0x4], header[0x114:0x118]) {
+		return nil, &HashMismatchError{
+			Location: Location{Structure: "ncch", Offset: 0x114},
+			Subject:  fmt.Sprintf("seed of title %s", titleID),
+		}
+	}
+
+	return sha256Hash(append(append([]byte(nil), header[:0x10]...), seed...))[:0x10], nil
+}
+
+// ncchIV returns the initial counter of the given section.
+func ncchIV(header []byte, section byte, offset int64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	partitionID := binary.LittleEndian.Uint64(header[0x108:])
+
+	if binary.LittleEndian.Uint16(header[0x112:]) == 1 {
+		binary.LittleEndian.PutUint64(iv, partitionID)
+		binary.BigEndian.PutUint32(iv[12:], uint32(offset))
+	} else {
+		binary.BigEndian.PutUint64(iv, partitionID)
+		iv[8] = section
+	}
+
+	return iv
+}
+
+// ncchSpan is a range of offsets, from start included to end excluded.
+type ncchSpan struct {
+	start int64
+	end   int64
+}
+
+// ncchExeFSSpans returns the parts of the ExeFS that are encrypted with the secondary key, sorted
+// by offset and without overlaps.
+//
+// Only "icon" and "banner" are encrypted with the primary key, along with the header and the
+// padding between files.
+func ncchExeFSSpans(exefsHeader []byte, exefsSize int64) ([]ncchSpan, error) {
+	files := make([]ncchSpan, 0)
+	for i := 0; i < 10; i++ {
+		fileHeader := exefsHeader[i*0x10 : (i+1)*0x10]
+		fileName := string(bytes.TrimRight(fileHeader[:0x8], "\x00"))
+		fileOffset := 0x200 + int64(binary.LittleEndian.Uint32(fileHeader[0x8:]))
+		fileSize := int64(binary.LittleEndian.Uint32(fileHeader[0xc:]))
+		if fileSize == 0 || fileName == "icon" || fileName == "banner" {
+			continue
+		}
+		if fileOffset+fileSize > exefsSize {
+			return nil, fmt.Errorf("ncch: ExeFS file %q exceeds ExeFS bounds", fileName)
+		}
+		files = append(files, ncchSpan{fileOffset, fileOffset + fileSize})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].start < files[j].start })
+
+	spans := make([]ncchSpan, 0, len(files))
+	cursor := int64(0)
+	for _, s := range files {
+		if s.start < cursor {
+			s.start = cursor
+		}
+		if s.start >= s.end {
+			continue
+		}
+		spans = append(spans, s)
+		cursor = s.end
+	}
+
+	return spans, nil
+}
+
+// ncchExeFSDecrypter decrypts an ExeFS read sequentially, switching between the primary and the
+// secondary keys once the ExeFS header is known.
+//
+// If the secondary key is not known, the affected data is left encrypted and missing reports
+// the corresponding error.
+type ncchExeFSDecrypter struct {
+	inner        io.Reader
+	size         int64
+	offset       int64
+	iv           []byte
+	primary      cipher.Block
+	secondary    cipher.Block
+	secondaryErr error
+	header       []byte
+	spans        []ncchSpan
+	missing      error
+}
+
+// newNCCHExeFSDecrypter wraps the given reader, which must be positioned at the beginning of the
+// ExeFS of the NCCH whose header is given.
+func newNCCHExeFSDecrypter(inner io.Reader, header []byte, exefsOffset, exefsSize int64) (*ncchExeFSDecrypter, error) {
+	primary, err := aes.NewCipher(ncchPrimaryKey(header))
+	if err != nil {
+		return nil, fmt.Errorf("ncch: failed to initialize AES cipher: %w", err)
+	}
+
+	var secondary cipher.Block
+	var missingKey *MissingKeyError
+	secondaryKey, secondaryErr := ncchSecondaryKey(header)
+	if secondaryErr != nil && !errors.As(secondaryErr, &missingKey) {
+		return nil, secondaryErr
+	} else if secondaryErr == nil {
+		secondary, err = aes.NewCipher(secondaryKey)
+		if err != nil {
+			return nil, fmt.Errorf("ncch: failed to initialize AES cipher: %w", err)
+		}
+	}
+
+	return &ncchExeFSDecrypter{
+		inner:        inner,
+		size:         exefsSize,
+		iv:           ncchIV(header, ncchExeFS, exefsOffset),
+		primary:      primary,
+		secondary:    secondary,
+		secondaryErr: secondaryErr,
+		header:       make([]byte, 0, 0x200),
+	}, nil
+}
+
+func (d *ncchExeFSDecrypter) Read(p []byte) (int, error) {
+	n, err := d.inner.Read(p)
+
+	data := p[:n]
+	for len(data) > 0 {
+		block := d.primary
+		end := d.offset + int64(len(data))
+
+		if len(d.header) < 0x200 {
+			if headerEnd := int64(0x200); end > headerEnd {
+				end = headerEnd
+			}
+		} else {
+			for len(d.spans) > 0 && d.spans[0].end <= d.offset {
+				d.spans = d.spans[1:]
+			}
+			if len(d.spans) > 0 {
+				span := d.spans[0]
+				if d.offset >= span.start {
+					block = d.secondary
+					if end > span.end {
+						end = span.end
+					}
+				} else if end > span.start {
+					end = span.start
+				}
+			}
+		}
+
+		chunk := data[:end-d.offset]
+		if block != nil {
+			ctrutil.NewCTR(block, d.iv, d.offset).XORKeyStream(chunk, chunk)
+		} else {
+			d.missing = d.secondaryErr
+		}
+
+		if len(d.header) < 0x200 {
+			d.header = append(d.header, chunk...)
+			if len(d.header) == 0x200 {
+				spans, spansErr := ncchExeFSSpans(d.header, d.size)
+				if spansErr != nil {
+					return n, spansErr
+				}
+				d.spans = spans
+			}
+		}
+
+		data = data[len(chunk):]
+		d.offset = end
+	}
+
+	return n, err
+}
+
+// ncchRegion is a part of an NCCH whose data is replaced by its encrypted or decrypted form.
+//
+// Regions returned by ncchRegions also provide the AES-CTR keystream that maps the input to data,
+// so that they can be applied to a stream (see ncchWriter).
+type ncchRegion struct {
+	offset int64
+	size   int64
+	data   io.ReaderAt
+	stream func() cipher.Stream
+}
+
+// ncchRegions returns the regions of the given NCCH that are subject to encryption, mapped
+// through the AES-CTR keystream. Since CTR is symmetric, the same regions allow to encrypt and
+// to decrypt. The ExeFS header is read in plaintext form if decrypted is true.
+func ncchRegions(input io.ReaderAt, size int64, header []byte, decrypted bool) ([]ncchRegion, error) {
+	primaryCipher, err := aes.NewCipher(ncchPrimaryKey(header))
+	if err != nil {
+		return nil, fmt.Errorf("ncch: failed to initialize AES cipher: %w", err)
+	}
+
+	secondaryKey, err := ncchSecondaryKey(header)
+	if err != nil {
+		return nil, err
+	}
+	secondaryCipher, err := aes.NewCipher(secondaryKey)
+	if err != nil {
+		return nil, fmt.Errorf("ncch: failed to initialize AES cipher: %w", err)
+	}
+
+	mediaUnit := ncchMediaUnit(header)
+	regions := make([]ncchRegion, 0)
+
+	section := func(name string, offset, length int64) (io.ReaderAt, error) {
+		if offset < 0x200 || length < 0 || offset+length > size {
+			return nil, fmt.Errorf("ncch: %s exceeds NCCH bounds", name)
+		}
+		return io.NewSectionReader(input, offset, length), nil
+	}
+
+	// ctrRegion maps a part of the given section through the keystream of this section.
+	ctrRegion := func(data io.ReaderAt, offset, start, length int64, block cipher.Block, iv []byte) ncchRegion {
+		return ncchRegion{
+			offset: offset + start,
+			size:   length,
+			data:   io.NewSectionReader(ctrutil.NewCTRAt(data, block, iv), start, length),
+			stream: func() cipher.Stream { return ctrutil.NewCTR(block, iv, start) },
+		}
+	}
+
+	if binary.LittleEndian.Uint32(header[0x180:]) > 0 {
+		data, err := section("ExHeader", 0x200, 0x800)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, ctrRegion(data, 0x200, 0, 0x800, primaryCipher, ncchIV(header, ncchExHeader, 0x200)))
+	}
+
+	exefsOffset := int64(binary.LittleEndian.Uint32(header[0x1a0:])) * mediaUnit
+	exefsSize := int64(binary.LittleEndian.Uint32(header[0x1a4:])) * mediaUnit
+	if exefsSize > 0 {
+		data, err := section("ExeFS", exefsOffset, exefsSize)
+		if err != nil {
+			return nil, err
+		}
+		iv := ncchIV(header, ncchExeFS, exefsOffset)
+
+		exefsHeader := make([]byte, 0x200)
+		source := ctrutil.NewCTRAt(data, primaryCipher, iv)
+		if decrypted {
+			source = data
+		}
+		_, err = source.ReadAt(exefsHeader, 0)
+		if err != nil {
+			return nil, fmt.Errorf("ncch: failed to read ExeFS header: %w", err)
+		}
+
+		spans, err := ncchExeFSSpans(exefsHeader, exefsSize)
+		if err != nil {
+			return nil, err
+		}
+
+		cursor := int64(0)
+		for _, s := range spans {
+			regions = append(regions, ctrRegion(data, exefsOffset, cursor, s.start-cursor, primaryCipher, iv))
+			regions = append(regions, ctrRegion(data, exefsOffset, s.start, s.end-s.start, secondaryCipher, iv))
+			cursor = s.end
+		}
+		regions = append(regions, ctrRegion(data, exefsOffset, cursor, exefsSize-cursor, primaryCipher, iv))
+	}
+
+	romfsOffset := int64(binary.LittleEndian.Uint32(header[0x1b0:])) * mediaUnit
+	romfsSize := int64(binary.LittleEndian.Uint32(header[0x1b4:])) * mediaUnit
+	if romfsSize > 0 {
+		data, err := section("RomFS", romfsOffset, romfsSize)
+		if err != nil {
+			return nil, err
+		}
+		regions = append(regions, ctrRegion(data, romfsOffset, 0, romfsSize, secondaryCipher, ncchIV(header, ncchRomFS, romfsOffset)))
+	}
+
+	sort.SliceStable(regions, func(i, j int) bool { return regions[i].offset < regions[j].offset })
+	for i := 1; i < len(regions); i++ {
+		if regions[i].offset < regions[i-1].offset+regions[i-1].size {
+			return nil, fmt.Errorf("ncch: encrypted regions overlap")
+		}
+	}
+
+	return regions, nil
+}
+
+// ncchReader returns the content of the given NCCH, with a replaced header and the given regions
+// replaced.
+func ncchReader(input io.ReaderAt, size int64, header []byte, regions []ncchRegion) io.Reader {
+	parts := []io.Reader{bytes.NewReader(header)}
+
+	offset := int64(len(header))
+	for _, region := range regions {
+		parts = append(parts, io.NewSectionReader(input, offset, region.offset-offset))
+		parts = append(parts, io.NewSectionReader(region.data, 0, region.size))
+		offset = region.offset + region.size
+	}
+	parts = append(parts, io.NewSectionReader(input, offset, size-offset))
+
+	return io.MultiReader(parts...)
+}
+
+// ncchWriter writes the content of an NCCH streamed through Write, with a replaced header and the
+// given regions mapped through their keystream. This is the streaming form of ncchReader, for
+// regions returned by ncchRegions.
+type ncchWriter struct {
+	w       io.Writer
+	header  []byte
+	regions []ncchRegion
+	offset  int64
+	stream  cipher.Stream
+	buf     []byte
+}
+
+func newNCCHWriter(w io.Writer, header []byte, regions []ncchRegion) *ncchWriter {
+	return &ncchWriter{w: w, header: header, regions: regions}
+}
+
+func (n *ncchWriter) Write(p []byte) (int, error) {
+	if cap(n.buf) < len(p) {
+		n.buf = make([]byte, len(p))
+	}
+	buf := n.buf[:len(p)]
+	copy(buf, p)
+
+	for data := buf; len(data) > 0; {
+		end := n.offset + int64(len(data))
+		var stream cipher.Stream
+
+		if n.offset < int64(len(n.header)) {
+			if end > int64(len(n.header)) {
+				end = int64(len(n.header))
+			}
+			copy(data, n.header[n.offset:end])
+		} else {
+			for len(n.regions) > 0 && n.regions[0].offset+n.regions[0].size <= n.offset {
+				n.regions = n.regions[1:]
+				n.stream = nil
+			}
+			if len(n.regions) > 0 {
+				region := n.regions[0]
+				if n.offset >= region.offset {
+					if n.stream == nil {
+						n.stream = region.stream()
+					}
+					stream = n.stream
+					if end > region.offset+region.size {
+						end = region.offset + region.size
+					}
+				} else if end > region.offset {
+					end = region.offset
+				}
+			}
+		}
+
+		chunk := data[:end-n.offset]
+		if stream != nil {
+			stream.XORKeyStream(chunk, chunk)
+		}
+		data = data[len(chunk):]
+		n.offset = end
+	}
+
+	return n.w.Write(buf)
+}
+
+// DecryptNCCH writes a decrypted copy of the given NCCH file.
+//
+// The ExHeader, the ExeFS and the RomFS are decrypted, and the header is updated to use the
+// NoCrypto flag. NCCH files that are not encrypted are copied as is.
+func DecryptNCCH(r io.ReaderAt, size int64, w io.Writer) error {
+	header := make([]byte, 0x200)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return fmt.Errorf("ncch: failed to read header: %w", err)
+	}
+
+	if string(header[0x100:0x104]) != "NCCH" {
+		return fmt.Errorf("ncch: magic not found")
+	}
+
+	flags := header[0x188:0x190]
+	if flags[7]&ncchNoCrypto != 0 {
+		_, err = io.Copy(w, io.NewSectionReader(r, 0, size))
+		return err
+	}
+
+	regions, err := ncchRegions(r, size, header, false)
+	if err != nil {
+		return err
+	}
+
+	decryptedHeader := append([]byte(nil), header...)
+	decryptedFlags := decryptedHeader[0x188:0x190]
+	decryptedFlags[3] = 0x00
+	decryptedFlags[7] = decryptedFlags[7]&^(ncchFixedKey|ncchSeed) | ncchNoCrypto
+
+	_, err = io.Copy(w, ncchReader(r, size, decryptedHeader, regions))
+	if err != nil {
+		return fmt.Errorf("ncch: failed to write: %w", err)
+	}
+	return nil
+}
+
+// NCCHCrypto describes the encryption of an NCCH, as set in its flags.
+type NCCHCrypto struct {
+	// NoCrypto disables encryption altogether.
+	NoCrypto bool
+
+	// FixedKey selects a fixed key instead of a key derived from the header.
+	FixedKey bool
+
+	// Method selects the key used for the RomFS and most ExeFS files. Methods other than 0x00
+	// need a KeyX provided through Keys.
+	Method uint8
+
+	// Seed derives the key used for the RomFS and most ExeFS files from the seed of the title,
+	// which must be provided through Keys.Seeds.
+	Seed bool
+}
+
+// encryptedNCCHReader returns the content of the given decrypted NCCH, once encrypted as
+// described by crypto.
+func encryptedNCCHReader(r io.ReaderAt, size int64, crypto NCCHCrypto) (io.Reader, error) {
+	header, regions, err := encryptedNCCHRegions(r, size, crypto)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return io.NewSectionReader(r, 0, size), nil
+	}
+	return ncchReader(r, size, header, regions), nil
+}
+
+// encryptedNCCHRegions returns the header and the regions of the given decrypted NCCH, once
+// encrypted as described by crypto. Both are nil if crypto leaves the NCCH unchanged.
+func encryptedNCCHRegions(r io.ReaderAt, size int64, crypto NCCHCrypto) ([]byte, []ncchRegion, error) {
+	header := make([]byte, 0x200)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ncch: failed to read header: %w", err)
+	}
+
+	if string(header[0x100:0x104]) != "NCCH" {
+		return nil, nil, fmt.Errorf("ncch: magic not found")
+	}
+
+	flags := header[0x188:0x190]
+	if flags[7]&ncchNoCrypto == 0 {
+		return nil, nil, fmt.Errorf("ncch: already encrypted")
+	}
+
+	if crypto.NoCrypto {
+		return nil, nil, nil
+	}
+
+	encryptedHeader := append([]byte(nil), header...)
+	encryptedFlags := encryptedHeader[0x188:0x190]
+	encryptedFlags[3] = crypto.Method
+	encryptedFlags[7] &^= ncchNoCrypto | ncchFixedKey | ncchSeed
+	if crypto.FixedKey {
+		encryptedFlags[7] |= ncchFixedKey
+	}
+	if crypto.Seed {
+		encryptedFlags[7] |= ncchSeed
+	}
+
+	regions, err := ncchRegions(r, size, encryptedHeader, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encryptedHeader, regions, nil
+}
+
+// EncryptNCCH writes an encrypted copy of the given decrypted NCCH file, as described by crypto.
+//
+// This is the inverse of DecryptNCCH, provided that the original encryption is known.
+func EncryptNCCH(r io.ReaderAt, size int64, w io.Writer, crypto NCCHCrypto) error {
+	data, err := encryptedNCCHReader(r, size, crypto)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, data)
+	if err != nil {
+		return fmt.Errorf("ncch: failed to write: %w", err)
+	}
+	return nil
+}
+
+// ncchRomFSReader returns the decrypted RomFS of the given NCCH, or nil if it has none.
+func ncchRomFSReader(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+	header := make([]byte, 0x200)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("ncch: failed to read header: %w", err)
+	}
+
+	mediaUnit := ncchMediaUnit(header)
+	romfsOffset := int64(binary.LittleEndian.Uint32(header[0x1b0:])) * mediaUnit
+	romfsSize := int64(binary.LittleEndian.Uint32(header[0x1b4:])) * mediaUnit
+	if romfsSize == 0 {
+		return nil, nil
+	}
+	if romfsOffset < 0x200 || romfsOffset+romfsSize > size {
+		return nil, fmt.Errorf("ncch: RomFS exceeds NCCH bounds")
+	}
+
+	var data io.ReaderAt = io.NewSectionReader(r, romfsOffset, romfsSize)
+	if header[0x18f]&ncchNoCrypto == 0 {
+		key, err := ncchSecondaryKey(header)
+		if err != nil {
+			return nil, err
+		}
+		romfsCipher, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("ncch: failed to initialize RomFS cipher: %w", err)
+		}
+		data = ctrutil.NewCTRAt(data, romfsCipher, ncchIV(header, ncchRomFS, romfsOffset))
+	}
+
+	return io.NewSectionReader(data, 0, romfsSize), nil
+}
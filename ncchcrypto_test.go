@@ -0,0 +1,108 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNCCHSeedKeyY(t *testing.T) {
+	const titleID = 0x0004000000123400
+	seed := mustDecodeHex(t, "101112131415161718191a1b1c1d1e1f")
+
+	header := make([]byte, 0x200)
+	copy(header, mustDecodeHex(t, "000102030405060708090a0b0c0d0e0f"))
+	// SHA256(seed || program ID)[:4]
+	copy(header[0x114:], mustDecodeHex(t, "55c66842"))
+	binary.LittleEndian.PutUint64(header[0x118:], titleID)
+
+	tests := []struct {
+		name  string
+		seeds SeedDB
+		keyY  string
+		err   interface{}
+	}{
+		// SHA256(signature[:0x10] || seed)[:0x10]
+		{"valid seed", SeedDB{titleID: seed}, "630dcd2966c4336691125448bbb25b4f", nil},
+		{"missing seed", SeedDB{}, "", new(*MissingKeyError)},
+		{"wrong seed", SeedDB{titleID: make([]byte, 0x10)}, "", new(*HashMismatchError)},
+	}
+
+	defer func(seeds SeedDB) { Keys.Seeds = seeds }(Keys.Seeds)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Keys.Seeds = test.seeds
+			keyY, err := ncchSeedKeyY(header)
+			if test.err != nil {
+				if !errors.As(err, test.err) {
+					t.Fatalf("ncchSeedKeyY error = %v, want %T", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ncchSeedKeyY: %v", err)
+			}
+			if want := mustDecodeHex(t, test.keyY); !bytes.Equal(keyY, want) {
+				t.Errorf("ncchSeedKeyY = %x, want %x", keyY, want)
+			}
+		})
+	}
+}
+
+func TestNCCHSecondaryKeyX(t *testing.T) {
+	keyX25 := bytes.Repeat([]byte{0x25}, 0x10)
+	keyX18 := bytes.Repeat([]byte{0x18}, 0x10)
+
+	tests := []struct {
+		name   string
+		method byte
+		keyX   []byte
+		err    interface{}
+	}{
+		{"original", 0x00, ncchKeyX, nil},
+		{"7.x", 0x01, keyX25, nil},
+		{"New 3DS 9.3", 0x0a, keyX18, nil},
+		{"New 3DS 9.6 without key", 0x0b, nil, new(*MissingKeyError)},
+		{"unknown", 0x02, nil, nil},
+	}
+
+	defer func(keyX25, keyX18, keyX1B []byte) {
+		Keys.KeyX25, Keys.KeyX18, Keys.KeyX1B = keyX25, keyX18, keyX1B
+	}(Keys.KeyX25, Keys.KeyX18, Keys.KeyX1B)
+	Keys.KeyX25, Keys.KeyX18, Keys.KeyX1B = keyX25, keyX18, nil
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyX, err := ncchSecondaryKeyX(test.method)
+			if test.err != nil {
+				if !errors.As(err, test.err) {
+					t.Fatalf("ncchSecondaryKeyX error = %v, want %T", err, test.err)
+				}
+				return
+			}
+			if test.keyX == nil {
+				if err == nil {
+					t.Fatalf("ncchSecondaryKeyX = %x, want an error", keyX)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ncchSecondaryKeyX: %v", err)
+			}
+			if !bytes.Equal(keyX, test.keyX) {
+				t.Errorf("ncchSecondaryKeyX = %x, want %x", keyX, test.keyX)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package ctrsigcheck
+
+// Options control the strictness and the behavior of the various checks.
+//
+// The zero value enables every check and corresponds to the behavior of the functions that don't
+// take any options.
+type Options struct {
+	// AllowExtraneousData tolerates unexpected data after the end of a file.
+	AllowExtraneousData bool
+
+	// AllowMissingContents tolerates missing contents, even if they are not optional.
+	AllowMissingContents bool
+
+	// SkipContentHashes disables the verification of content hashes.
+	SkipContentHashes bool
+
+	// SkipNCCH disables the parsing of contents as NCCH files.
+	SkipNCCH bool
+
+	// SkipExeFS disables the parsing of the ExeFS embedded in NCCH files.
+	SkipExeFS bool
+
+	// SkipRomFS disables the verification of the hash tree of the RomFS embedded in NCCH files.
+	SkipRomFS bool
+
+	// SkipSMDH disables the parsing of the icon embedded in ExeFS files.
+	SkipSMDH bool
+
+	// RequireLegit turns invalid Nintendo signatures into errors.
+	RequireLegit bool
+
+	// RequireKeys turns encrypted NCCH data that cannot be decrypted, because the needed key is
+	// not known, into errors (see MissingKeyError). Otherwise, such data is not verified and is
+	// listed as unverified.
+	RequireKeys bool
+}
+
+var defaultOptions Options
+
+func (o *Options) orDefault() *Options {
+	if o == nil {
+		return &defaultOptions
+	}
+	return o
+}
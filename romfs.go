@@ -0,0 +1,397 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+const romfsNone = 0xffffffff
+
+// romfsLevel3 gives access to the file system stored in the level 3 of a RomFS.
+type romfsLevel3 struct {
+	r          io.ReaderAt
+	size       int64
+	dirMeta    []byte
+	fileMeta   []byte
+	dataOffset int64
+}
+
+// romfsFile describes a file found in a RomFS.
+type romfsFile struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+// ivfcLevel describes a level of the IVFC hash tree of a RomFS. The offset is relative to the
+// beginning of the RomFS.
+type ivfcLevel struct {
+	offset    int64
+	size      int64
+	blockSize int64
+}
+
+// parseIVFCHeader returns the size of the master hash and the levels 1 to 3 described by the given
+// RomFS header.
+//
+// The level 3 follows the master hash, and is itself followed by the levels 1 and 2. Each level
+// is aligned to its block size.
+func parseIVFCHeader(header []byte) (int64, [3]ivfcLevel, error) {
+	var levels [3]ivfcLevel
+
+	if string(header[:0x4]) != "IVFC" || binary.LittleEndian.Uint32(header[0x4:]) != 0x10000 {
+		return 0, levels, fmt.Errorf("romfs: magic not found")
+	}
+
+	masterHashSize := int64(binary.LittleEndian.Uint32(header[0x8:]))
+
+	for i := range levels {
+		descriptor := header[0xc+i*0x18:]
+		size := binary.LittleEndian.Uint64(descriptor[0x8:])
+		blockSizeLog2 := binary.LittleEndian.Uint32(descriptor[0x10:])
+		if size >= 1<<62 {
+			return 0, levels, fmt.Errorf("romfs: level %d is too large: %d", i+1, size)
+		}
+		if blockSizeLog2 < 5 || blockSizeLog2 > 30 {
+			return 0, levels, fmt.Errorf("romfs: unsupported block size for level %d: 2^%d", i+1, blockSizeLog2)
+		}
+		levels[i].size = int64(size)
+		levels[i].blockSize = 1 << blockSizeLog2
+	}
+
+	align := func(offset, alignment int64) int64 {
+		return offset + (alignment-offset%alignment)%alignment
+	}
+	levels[2].offset = align(0x60+masterHashSize, levels[2].blockSize)
+	levels[0].offset = align(levels[2].offset+levels[2].size, levels[0].blockSize)
+	levels[1].offset = align(levels[0].offset+levels[0].size, levels[1].blockSize)
+
+	return masterHashSize, levels, nil
+}
+
+// openRomFS locates the level 3 of the given RomFS, and reads its metadata.
+func openRomFS(r io.ReaderAt, size int64) (*romfsLevel3, error) {
+	header := make([]byte, 0x5c)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("romfs: failed to read header: %w", err)
+	}
+
+	_, levels, err := parseIVFCHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	level3Offset := levels[2].offset
+	level3Size := levels[2].size
+	if level3Size < 0x28 || level3Offset+level3Size > size {
+		return nil, fmt.Errorf("romfs: level 3 exceeds RomFS bounds")
+	}
+	level3 := io.NewSectionReader(r, level3Offset, level3Size)
+
+	level3Header := make([]byte, 0x28)
+	_, err = level3.ReadAt(level3Header, 0)
+	if err != nil {
+		return nil, fmt.Errorf("romfs: failed to read level 3 header: %w", err)
+	}
+
+	readTable := func(name string, offsetField, sizeField int) ([]byte, error) {
+		offset := int64(binary.LittleEndian.Uint32(level3Header[offsetField:]))
+		size := int64(binary.LittleEndian.Uint32(level3Header[sizeField:]))
+		if offset+size > level3Size {
+			return nil, fmt.Errorf("romfs: %s exceeds level 3 bounds", name)
+		}
+		table := make([]byte, size)
+		_, err := level3.ReadAt(table, offset)
+		if err != nil {
+			return nil, fmt.Errorf("romfs: failed to read %s: %w", name, err)
+		}
+		return table, nil
+	}
+
+	dirMeta, err := readTable("directory metadata", 0xc, 0x10)
+	if err != nil {
+		return nil, err
+	}
+	fileMeta, err := readTable("file metadata", 0x1c, 0x20)
+	if err != nil {
+		return nil, err
+	}
+
+	dataOffset := int64(binary.LittleEndian.Uint32(level3Header[0x24:]))
+	if dataOffset > level3Size {
+		return nil, fmt.Errorf("romfs: file data exceeds level 3 bounds")
+	}
+
+	return &romfsLevel3{
+		r:          level3,
+		size:       level3Size,
+		dirMeta:    dirMeta,
+		fileMeta:   fileMeta,
+		dataOffset: dataOffset,
+	}, nil
+}
+
+// romfsEntryName decodes the name of a metadata entry whose fixed part has the given length.
+func romfsEntryName(table []byte, offset uint32, fixedLen int) (string, error) {
+	if uint64(offset)+uint64(fixedLen) > uint64(len(table)) {
+		return "", fmt.Errorf("romfs: metadata entry out of bounds")
+	}
+	entry := table[offset:]
+	nameLen := int(binary.LittleEndian.Uint32(entry[fixedLen-0x4:]))
+	if nameLen%2 != 0 || fixedLen+nameLen > len(entry) {
+		return "", fmt.Errorf("romfs: invalid name length: %d", nameLen)
+	}
+	return ctrutil.DecodeUTF16(entry[fixedLen:fixedLen+nameLen], binary.LittleEndian), nil
+}
+
+// romfsChildName decodes the name of a metadata entry like romfsEntryName, and rejects names that
+// cannot designate a child of a directory.
+func romfsChildName(table []byte, offset uint32, fixedLen int) (string, error) {
+	name, err := romfsEntryName(table, offset, fixedLen)
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return "", fmt.Errorf("romfs: invalid entry name: %q", name)
+	}
+	return name, nil
+}
+
+// romfsDir describes a directory found in a RomFS.
+type romfsDir struct {
+	path   string
+	offset uint32
+}
+
+// readDir returns the subdirectories and the files of the given directory, in metadata order.
+func (l *romfsLevel3) readDir(dir romfsDir) ([]romfsDir, []romfsFile, error) {
+	if _, err := romfsEntryName(l.dirMeta, dir.offset, 0x18); err != nil {
+		return nil, nil, err
+	}
+	entry := l.dirMeta[dir.offset:]
+
+	dirs := make([]romfsDir, 0)
+	visited := make(map[uint32]bool)
+	for child := binary.LittleEndian.Uint32(entry[0x8:]); child != romfsNone; {
+		if visited[child] {
+			return nil, nil, fmt.Errorf("romfs: directory loop detected")
+		}
+		visited[child] = true
+
+		name, err := romfsChildName(l.dirMeta, child, 0x18)
+		if err != nil {
+			return nil, nil, err
+		}
+		dirs = append(dirs, romfsDir{
+			path:   path.Join(dir.path, name),
+			offset: child,
+		})
+
+		child = binary.LittleEndian.Uint32(l.dirMeta[child+0x4:])
+	}
+
+	files := make([]romfsFile, 0)
+	visited = make(map[uint32]bool)
+	for file := binary.LittleEndian.Uint32(entry[0xc:]); file != romfsNone; {
+		if visited[file] {
+			return nil, nil, fmt.Errorf("romfs: file loop detected")
+		}
+		visited[file] = true
+
+		name, err := romfsChildName(l.fileMeta, file, 0x20)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileEntry := l.fileMeta[file:]
+		offset := binary.LittleEndian.Uint64(fileEntry[0x8:])
+		size := binary.LittleEndian.Uint64(fileEntry[0x10:])
+		if offset > uint64(l.size) || size > uint64(l.size)-offset || l.dataOffset+int64(offset+size) > l.size {
+			return nil, nil, fmt.Errorf("romfs: file %s exceeds level 3 bounds", path.Join(dir.path, name))
+		}
+
+		files = append(files, romfsFile{
+			path:   path.Join(dir.path, name),
+			offset: l.dataOffset + int64(offset),
+			size:   int64(size),
+		})
+
+		file = binary.LittleEndian.Uint32(fileEntry[0x4:])
+	}
+
+	return dirs, files, nil
+}
+
+// walk calls fn for each file of the RomFS, in metadata order.
+func (l *romfsLevel3) walk(fn func(file romfsFile) error) error {
+	visited := make(map[uint32]bool)
+
+	var walkDir func(dir romfsDir) error
+	walkDir = func(dir romfsDir) error {
+		if visited[dir.offset] {
+			return fmt.Errorf("romfs: directory loop detected")
+		}
+		visited[dir.offset] = true
+
+		dirs, files, err := l.readDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			err = fn(file)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, child := range dirs {
+			err = walkDir(child)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return walkDir(romfsDir{path: "/", offset: 0})
+}
+
+// open returns the content of the given file.
+func (l *romfsLevel3) open(file romfsFile) *io.SectionReader {
+	return io.NewSectionReader(l.r, file.offset, file.size)
+}
+
+// romfsMaxReportedBlocks limits the number of failing blocks listed in a RomFSHashError.
+const romfsMaxReportedBlocks = 1000
+
+// CheckRomFS reads the given decrypted RomFS and verifies its IVFC hash tree.
+//
+// The master hash must match the hashes of the level 1 blocks, the level 1 must match the hashes
+// of the level 2 blocks, and the level 2 must match the hashes of the level 3 blocks, which contain
+// the file system. Failing blocks are reported by a RomFSHashError. The last block of each level is
+// padded with zeros.
+//
+// The RomFS is read sequentially, but only up to the end of the level 2: the caller is responsible
+// for consuming the rest.
+func CheckRomFS(input io.Reader, size int64) error {
+	reader := ctrutil.NewReader(input)
+
+	header := make([]byte, 0x60)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return fmt.Errorf("romfs: failed to read header: %w", err)
+	}
+
+	masterHashSize, levels, err := parseIVFCHeader(header)
+	if err != nil {
+		return err
+	}
+
+	if levels[1].offset+levels[1].size > size {
+		return fmt.Errorf("romfs: level 2 exceeds RomFS size")
+	}
+
+	hashNames := []string{"master hash", "level 1", "level 2"}
+	hashSizes := []int64{masterHashSize, levels[0].size, levels[1].size}
+	for i, level := range levels {
+		blocks := (level.size + level.blockSize - 1) / level.blockSize
+		if hashSizes[i] < blocks*0x20 {
+			return fmt.Errorf("romfs: %s is too small to hash level %d", hashNames[i], i+1)
+		}
+	}
+
+	master := make([]byte, masterHashSize)
+	_, err = io.ReadFull(reader, master)
+	if err != nil {
+		return fmt.Errorf("romfs: failed to read master hash: %w", err)
+	}
+
+	// Levels are read in their physical order: 3, 1, then 2.
+	var data [3][]byte
+	var hashes [3][]byte
+	for _, i := range []int{2, 0, 1} {
+		level := levels[i]
+
+		err = reader.Discard(level.offset - reader.Offset())
+		if err != nil {
+			return fmt.Errorf("romfs: failed to jump to level %d: %w", i+1, err)
+		}
+
+		var levelReader io.Reader = io.LimitReader(reader, level.size)
+		if i < 2 {
+			// Levels 1 and 2 are kept to verify the next level.
+			data[i] = make([]byte, level.size)
+			_, err = io.ReadFull(levelReader, data[i])
+			if err != nil {
+				return fmt.Errorf("romfs: failed to read level %d: %w", i+1, err)
+			}
+			levelReader = bytes.NewReader(data[i])
+		}
+
+		hashes[i], err = hashIVFCLevel(levelReader, level)
+		if err != nil {
+			return fmt.Errorf("romfs: failed to read level %d: %w", i+1, err)
+		}
+	}
+
+	hashErr := &RomFSHashError{
+		Location: Location{Structure: "romfs"},
+		Blocks:   make([]RomFSBlock, 0),
+	}
+	expected := [][]byte{master, data[0], data[1]}
+	for i, level := range levels {
+		for block := 0; block*0x20 < len(hashes[i]); block++ {
+			hash := hashes[i][block*0x20 : (block+1)*0x20]
+			if bytes.Equal(hash, expected[i][block*0x20:(block+1)*0x20]) {
+				continue
+			}
+
+			offset := level.offset + int64(block)*level.blockSize
+			if hashErr.Count == 0 {
+				hashErr.Offset = offset
+			}
+			if hashErr.Count < romfsMaxReportedBlocks {
+				hashErr.Blocks = append(hashErr.Blocks, RomFSBlock{Level: i + 1, Offset: offset})
+			}
+			hashErr.Count++
+		}
+	}
+	if hashErr.Count > 0 {
+		return hashErr
+	}
+
+	return nil
+}
+
+// hashIVFCLevel returns the concatenated hashes of the blocks of the given level, read from input.
+func hashIVFCLevel(input io.Reader, level ivfcLevel) ([]byte, error) {
+	blocks := (level.size + level.blockSize - 1) / level.blockSize
+	hashes := make([]byte, 0, blocks*0x20)
+	block := make([]byte, level.blockSize)
+
+	for remaining := level.size; remaining > 0; {
+		n := level.blockSize
+		if n > remaining {
+			// The last block is padded with zeros.
+			n = remaining
+			block = make([]byte, level.blockSize)
+		}
+
+		_, err := io.ReadFull(input, block[:n])
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, sha256Hash(block)...)
+		remaining -= n
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,100 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// buildIVFC returns a RomFS image with a valid IVFC hash tree, using blocks of 0x40 bytes. The
+// level 3 is made of 4 blocks, the level 2 of 2 blocks and the level 1 of a single block:
+//
+//	0x000 header, 0x060 master hash, 0x080 level 3, 0x180 level 1, 0x1c0 level 2
+func buildIVFC() []byte {
+	const blockSize = 0x40
+	hashLevel := func(level []byte) []byte {
+		hashes := make([]byte, 0, len(level)/blockSize*0x20)
+		for i := 0; i < len(level); i += blockSize {
+			hash := sha256.Sum256(level[i : i+blockSize])
+			hashes = append(hashes, hash[:]...)
+		}
+		return hashes
+	}
+
+	level3 := make([]byte, 4*blockSize)
+	for i := range level3 {
+		level3[i] = byte(i)
+	}
+	level2 := hashLevel(level3)
+	level1 := hashLevel(level2)
+	master := hashLevel(level1)
+
+	image := make([]byte, 0x240)
+	copy(image, "IVFC")
+	binary.LittleEndian.PutUint32(image[0x4:], 0x10000)
+	binary.LittleEndian.PutUint32(image[0x8:], uint32(len(master)))
+	for i, level := range [][]byte{level1, level2, level3} {
+		descriptor := image[0xc+i*0x18:]
+		binary.LittleEndian.PutUint64(descriptor[0x8:], uint64(len(level)))
+		binary.LittleEndian.PutUint32(descriptor[0x10:], 6)
+	}
+	binary.LittleEndian.PutUint32(image[0x54:], 0x5c)
+	copy(image[0x60:], master)
+	copy(image[0x80:], level3)
+	copy(image[0x180:], level1)
+	copy(image[0x1c0:], level2)
+	return image
+}
+
+func TestCheckRomFSHashes(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt int64
+		blocks  []RomFSBlock
+	}{
+		{"valid", -1, nil},
+		{"master hash", 0x60, []RomFSBlock{{Level: 1, Offset: 0x180}}},
+		{"level 3 first block", 0x80, []RomFSBlock{{Level: 3, Offset: 0x80}}},
+		{"level 3 last block", 0x17f, []RomFSBlock{{Level: 3, Offset: 0x140}}},
+		// Corrupted hashes are checked themselves, then used to check the next level.
+		{"level 1 second hash", 0x1a0, []RomFSBlock{
+			{Level: 1, Offset: 0x180},
+			{Level: 2, Offset: 0x200},
+		}},
+		{"level 2 second block", 0x200, []RomFSBlock{
+			{Level: 2, Offset: 0x200},
+			{Level: 3, Offset: 0x100},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image := buildIVFC()
+			if test.corrupt >= 0 {
+				image[test.corrupt] ^= 0xff
+			}
+
+			err := CheckRomFS(bytes.NewReader(image), int64(len(image)))
+			if test.blocks == nil {
+				if err != nil {
+					t.Fatalf("CheckRomFS: %v", err)
+				}
+				return
+			}
+
+			var hashErr *RomFSHashError
+			if !errors.As(err, &hashErr) {
+				t.Fatalf("CheckRomFS error = %v, want a RomFSHashError", err)
+			}
+			if hashErr.Offset != test.blocks[0].Offset {
+				t.Errorf("Offset = %#x, want %#x", hashErr.Offset, test.blocks[0].Offset)
+			}
+			if !reflect.DeepEqual(hashErr.Blocks, test.blocks) || hashErr.Count != len(test.blocks) {
+				t.Errorf("Blocks = %+v (Count %d), want %+v", hashErr.Blocks, hashErr.Count, test.blocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package ctrsigcheck
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RomFS gives read-only access to the file system stored in a RomFS, implementing fs.FS and
+// fs.ReadDirFS.
+//
+// Only the metadata tables of the level 3 are read when opening. File contents are read, and
+// decrypted if needed, on demand. Unlike CheckRomFS, the IVFC hash tree is not verified.
+type RomFS struct {
+	level3 *romfsLevel3
+}
+
+// OpenRomFS reads the metadata of the given decrypted RomFS.
+func OpenRomFS(r io.ReaderAt, size int64) (*RomFS, error) {
+	level3, err := openRomFS(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &RomFS{level3}, nil
+}
+
+// OpenNCCHRomFS reads the metadata of the RomFS embedded in the given NCCH (CXI or CFA).
+//
+// If the NCCH is encrypted, the RomFS is decrypted lazily with the secondary key.
+func OpenNCCHRomFS(r io.ReaderAt, size int64) (*RomFS, error) {
+	romfs, err := ncchRomFSReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if romfs == nil {
+		return nil, fmt.Errorf("ncch: no RomFS")
+	}
+	return OpenRomFS(romfs, romfs.Size())
+}
+
+// Open implements fs.FS. Returned files implement io.ReaderAt and io.Seeker, and returned
+// directories implement fs.ReadDirFile.
+func (r *RomFS) Open(name string) (fs.File, error) {
+	dir, file, err := r.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if file != nil {
+		return &romfsFileHandle{
+			SectionReader: r.level3.open(*file),
+			info:          romfsFileInfo{name: path.Base(file.path), size: file.size},
+		}, nil
+	}
+	return &romfsDirHandle{romfs: r, dir: dir}, nil
+}
+
+// ReadDir implements fs.ReadDirFS. Entries are sorted by name.
+func (r *RomFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dir, file, err := r.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if file != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := r.readDir(dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// readDir lists the entries of the given directory, sorted by name.
+func (r *RomFS) readDir(dir romfsDir) ([]fs.DirEntry, error) {
+	dirs, files, err := r.level3.readDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, 0, len(dirs)+len(files))
+	for _, child := range dirs {
+		entries = append(entries, romfsFileInfo{name: path.Base(child.path), dir: true})
+	}
+	for _, file := range files {
+		entries = append(entries, romfsFileInfo{name: path.Base(file.path), size: file.size})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// lookup resolves the given path. Either a directory or a file is returned. Directories that
+// would be entered twice are rejected, since they can only come from a metadata loop.
+func (r *RomFS) lookup(op, name string) (romfsDir, *romfsFile, error) {
+	dir := romfsDir{path: "/", offset: 0}
+	if !fs.ValidPath(name) {
+		return dir, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return dir, nil, nil
+	}
+
+	elems := strings.Split(name, "/")
+	visited := map[uint32]bool{dir.offset: true}
+	for i, elem := range elems {
+		dirs, files, err := r.level3.readDir(dir)
+		if err != nil {
+			return dir, nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		found := false
+		for _, child := range dirs {
+			if path.Base(child.path) == elem {
+				if visited[child.offset] {
+					return dir, nil, &fs.PathError{Op: op, Path: name, Err: errors.New("romfs: directory loop detected")}
+				}
+				visited[child.offset] = true
+				dir = child
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		if i == len(elems)-1 {
+			for _, file := range files {
+				if path.Base(file.path) == elem {
+					return dir, &file, nil
+				}
+			}
+		}
+
+		return dir, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+
+	return dir, nil, nil
+}
+
+// romfsFileInfo describes a RomFS entry, both as fs.FileInfo and fs.DirEntry.
+type romfsFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i romfsFileInfo) Name() string       { return i.name }
+func (i romfsFileInfo) Size() int64        { return i.size }
+func (i romfsFileInfo) ModTime() time.Time { return time.Time{} }
+func (i romfsFileInfo) IsDir() bool        { return i.dir }
+func (i romfsFileInfo) Sys() interface{}   { return nil }
+
+func (i romfsFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (i romfsFileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i romfsFileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// romfsFileHandle is a file opened from a RomFS.
+type romfsFileHandle struct {
+	*io.SectionReader
+	info romfsFileInfo
+}
+
+func (f *romfsFileHandle) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *romfsFileHandle) Close() error               { return nil }
+
+// romfsDirHandle is a directory opened from a RomFS. Its entries are listed on the first call to
+// ReadDir.
+type romfsDirHandle struct {
+	romfs   *RomFS
+	dir     romfsDir
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (d *romfsDirHandle) Stat() (fs.FileInfo, error) {
+	name := path.Base(d.dir.path)
+	if d.dir.path == "/" {
+		name = "."
+	}
+	return romfsFileInfo{name: name, dir: true}, nil
+}
+
+func (d *romfsDirHandle) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.dir.path, Err: errors.New("is a directory")}
+}
+
+func (d *romfsDirHandle) Close() error { return nil }
+
+func (d *romfsDirHandle) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		entries, err := d.romfs.readDir(d.dir)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.dir.path, Err: err}
+		}
+		d.entries = entries
+		d.listed = true
+	}
+
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
@@ -0,0 +1,103 @@
+package ctrsigcheck
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/connesc/ctrsigcheck/ctrutil"
+)
+
+// SeedDB maps title IDs to the 16-byte seeds of NCCHs that use seed crypto.
+//
+// The binary form, usually named seeddb.bin, starts with a 0x10-byte header holding the number of
+// entries, followed by 0x20-byte entries made of a title ID, a seed and some padding.
+type SeedDB map[Hex64]Hex
+
+// ParseSeedDB reads the given seeddb.bin file.
+func ParseSeedDB(input io.Reader) (SeedDB, error) {
+	reader := ctrutil.NewReader(input)
+
+	header := make([]byte, 0x10)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("seeddb: failed to read header: %w", err)
+	}
+
+	count := binary.LittleEndian.Uint32(header)
+	db := make(SeedDB)
+	entry := make([]byte, 0x20)
+	for i := uint32(0); i < count; i++ {
+		_, err = io.ReadFull(reader, entry)
+		if err != nil {
+			return nil, fmt.Errorf("seeddb: failed to read entry %d: %w", i, err)
+		}
+
+		titleID := Hex64(binary.LittleEndian.Uint64(entry))
+		err = db.add(titleID, entry[0x8:0x18])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// Merge adds the entries of other to db. Both may contain the same title, but only with the same
+// seed. On error, db is left unchanged.
+func (db SeedDB) Merge(other SeedDB) error {
+	for titleID, seed := range other {
+		err := db.check(titleID, seed)
+		if err != nil {
+			return err
+		}
+	}
+	for titleID, seed := range other {
+		db[titleID] = append(Hex(nil), seed...)
+	}
+	return nil
+}
+
+func (db SeedDB) add(titleID Hex64, seed []byte) error {
+	err := db.check(titleID, seed)
+	if err != nil {
+		return err
+	}
+	db[titleID] = append(Hex(nil), seed...)
+	return nil
+}
+
+// check tells whether the given seed can be added to db.
+func (db SeedDB) check(titleID Hex64, seed []byte) error {
+	if len(seed) != 0x10 {
+		return fmt.Errorf("seeddb: seed for title %s must have length %d, got %d", titleID, 0x10, len(seed))
+	}
+	if existing, ok := db[titleID]; ok && string(existing) != string(seed) {
+		return fmt.Errorf("seeddb: conflicting seeds for title %s", titleID)
+	}
+	return nil
+}
+
+// WriteTo writes db in the seeddb.bin format, with entries sorted by title ID.
+func (db SeedDB) WriteTo(w io.Writer) (int64, error) {
+	titleIDs := make([]Hex64, 0, len(db))
+	for titleID := range db {
+		titleIDs = append(titleIDs, titleID)
+	}
+	sort.Slice(titleIDs, func(i, j int) bool { return titleIDs[i] < titleIDs[j] })
+
+	data := make([]byte, 0x10+len(titleIDs)*0x20)
+	binary.LittleEndian.PutUint32(data, uint32(len(titleIDs)))
+	for i, titleID := range titleIDs {
+		entry := data[0x10+i*0x20:]
+		binary.LittleEndian.PutUint64(entry, uint64(titleID))
+		copy(entry[0x8:0x18], db[titleID])
+	}
+
+	n, err := w.Write(data)
+	if err != nil {
+		return int64(n), fmt.Errorf("seeddb: failed to write: %w", err)
+	}
+	return int64(n), nil
+}
@@ -0,0 +1,102 @@
+package ctrsigcheck
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSeedDBRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		db   SeedDB
+	}{
+		{"empty", SeedDB{}},
+		{"single", SeedDB{
+			0x0004000000123400: Hex(bytes.Repeat([]byte{0x11}, 0x10)),
+		}},
+		{"unsorted", SeedDB{
+			0x0004000000ffff00: Hex(bytes.Repeat([]byte{0x22}, 0x10)),
+			0x0004000000123400: Hex(bytes.Repeat([]byte{0x11}, 0x10)),
+			0x0004000000456700: Hex(bytes.Repeat([]byte{0x33}, 0x10)),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := test.db.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("WriteTo: %v", err)
+			}
+			if want := int64(0x10 + len(test.db)*0x20); n != want || int64(buf.Len()) != want {
+				t.Fatalf("WriteTo wrote %d bytes (buffer has %d), want %d", n, buf.Len(), want)
+			}
+
+			db, err := ParseSeedDB(&buf)
+			if err != nil {
+				t.Fatalf("ParseSeedDB: %v", err)
+			}
+			if !reflect.DeepEqual(db, test.db) {
+				t.Errorf("ParseSeedDB = %v, want %v", db, test.db)
+			}
+		})
+	}
+}
+
+func TestSeedDBMerge(t *testing.T) {
+	seed := Hex(bytes.Repeat([]byte{0x11}, 0x10))
+	other := Hex(bytes.Repeat([]byte{0x22}, 0x10))
+
+	tests := []struct {
+		name  string
+		other SeedDB
+		err   string
+	}{
+		{"new title", SeedDB{0x0004000000456700: other}, ""},
+		{"same seed", SeedDB{0x0004000000123400: seed}, ""},
+		{"conflicting seed", SeedDB{0x0004000000123400: other, 0x0004000000456700: other}, "seeddb: conflicting seeds for title"},
+		{"short seed", SeedDB{0x0004000000456700: other[:0x8]}, "seeddb: seed for title"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := SeedDB{0x0004000000123400: seed}
+			err := db.Merge(test.other)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("Merge: %v", err)
+				}
+				for titleID, seed := range test.other {
+					if !bytes.Equal(db[titleID], seed) {
+						t.Errorf("seed of title %s = %s, want %s", titleID, db[titleID], seed)
+					}
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Fatalf("Merge error = %v, want prefix %q", err, test.err)
+			}
+			if !reflect.DeepEqual(db, SeedDB{0x0004000000123400: seed}) {
+				t.Errorf("Merge modified the database on error: %v", db)
+			}
+		})
+	}
+}
+
+func TestParseSeedDBConflict(t *testing.T) {
+	data := make([]byte, 0x10+2*0x20)
+	data[0x0] = 2
+	for i, fill := range []byte{0x11, 0x22} {
+		entry := data[0x10+i*0x20:]
+		copy(entry, []byte{0x00, 0x34, 0x12, 0x00, 0x00, 0x00, 0x04, 0x00})
+		copy(entry[0x8:0x18], bytes.Repeat([]byte{fill}, 0x10))
+	}
+
+	_, err := ParseSeedDB(bytes.NewReader(data))
+	want := "seeddb: conflicting seeds for title 0004000000123400"
+	if err == nil || err.Error() != want {
+		t.Fatalf("ParseSeedDB error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,129 @@
+package ctrsigcheck
+
+import (
+	"crypto"
+	"crypto/rsa"
+)
+
+// SignatureType identifies the algorithm of a digital signature.
+//
+// Structures signed with ECDSA can be parsed, but their signatures cannot be verified.
+type SignatureType uint32
+
+// Signature types used by CTR and RVL structures.
+const (
+	RSA4096SHA1   SignatureType = 0x10000
+	RSA2048SHA1   SignatureType = 0x10001
+	ECDSASHA1     SignatureType = 0x10002
+	RSA4096SHA256 SignatureType = 0x10003
+	RSA2048SHA256 SignatureType = 0x10004
+	ECDSASHA256   SignatureType = 0x10005
+)
+
+// KeyType identifies the algorithm of a public key embedded in a certificate.
+type KeyType uint32
+
+// Key types used by CTR and RVL certificates.
+const (
+	RSA4096 KeyType = 0x0
+	RSA2048 KeyType = 0x1
+	ECC     KeyType = 0x2
+)
+
+type signatureSpec struct {
+	name       string
+	length     int
+	paddingLen int
+	hash       crypto.Hash
+	keyType    KeyType
+}
+
+var signatureSpecs = map[SignatureType]signatureSpec{
+	RSA4096SHA1:   {"RSA-4096-SHA1", 0x200, 0x3c, crypto.SHA1, RSA4096},
+	RSA2048SHA1:   {"RSA-2048-SHA1", 0x100, 0x3c, crypto.SHA1, RSA2048},
+	ECDSASHA1:     {"ECDSA-SHA1", 0x3c, 0x40, crypto.SHA1, ECC},
+	RSA4096SHA256: {"RSA-4096-SHA256", 0x200, 0x3c, crypto.SHA256, RSA4096},
+	RSA2048SHA256: {"RSA-2048-SHA256", 0x100, 0x3c, crypto.SHA256, RSA2048},
+	ECDSASHA256:   {"ECDSA-SHA256", 0x3c, 0x40, crypto.SHA256, ECC},
+}
+
+func (t SignatureType) String() string {
+	if spec, ok := signatureSpecs[t]; ok {
+		return spec.name
+	}
+	return Hex32(t).String()
+}
+
+// MarshalText implements encoding.TextMarshaler, also used for JSON encoding.
+func (t SignatureType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// sectionLen returns the length of the signature section, including the signature type and the
+// padding. Returns 0 for unknown signature types.
+func (t SignatureType) sectionLen() int {
+	spec, ok := signatureSpecs[t]
+	if !ok {
+		return 0
+	}
+	return 4 + spec.length + spec.paddingLen
+}
+
+// length returns the length of the signature itself. Returns 0 for unknown signature types.
+func (t SignatureType) length() int {
+	return signatureSpecs[t].length
+}
+
+func (t KeyType) String() string {
+	switch t {
+	case RSA4096:
+		return "RSA-4096"
+	case RSA2048:
+		return "RSA-2048"
+	case ECC:
+		return "ECC"
+	default:
+		return Hex32(t).String()
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler, also used for JSON encoding.
+func (t KeyType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// sectionLen returns the length of the public key section, including the exponent and the
+// padding. Returns 0 for unknown key types.
+func (t KeyType) sectionLen() int {
+	switch t {
+	case RSA4096:
+		return 0x200 + 0x4 + 0x34
+	case RSA2048:
+		return 0x100 + 0x4 + 0x34
+	case ECC:
+		return 0x3c + 0x3c
+	default:
+		return 0
+	}
+}
+
+// verifySignature checks that the given payload has been signed by the given certificate.
+//
+// ECDSA signatures are never considered valid, since the underlying curve (sect233r1) is not
+// supported.
+func verifySignature(cert *Certificate, signatureType SignatureType, signature, payload []byte) bool {
+	spec, ok := signatureSpecs[signatureType]
+	if !ok || spec.keyType != cert.KeyType || spec.keyType == ECC {
+		return false
+	}
+
+	var digest []byte
+	switch spec.hash {
+	case crypto.SHA1:
+		digest = sha1Hash(payload)
+	case crypto.SHA256:
+		digest = sha256Hash(payload)
+	}
+
+	return rsa.VerifyPKCS1v15(&cert.PublicKey, spec.hash, digest, signature) == nil
+}
@@ -16,6 +16,7 @@ type SMDH struct {
 	Title    SMDHTitle
 	Regions  []string
 	Graphics SMDHGraphics
+	raw      []byte
 }
 
 // SMDHTitle describes a title section embedded in a SMDH file.
@@ -115,5 +116,6 @@ func ParseSMDH(input io.Reader) (*SMDH, error) {
 			Small: smallIcon,
 			Large: largeIcon,
 		},
+		raw: data,
 	}, nil
 }
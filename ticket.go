@@ -2,10 +2,8 @@ package ctrsigcheck
 
 import (
 	"bytes"
-	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rsa"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -19,14 +17,33 @@ type TitleKey struct {
 	Decrypted Hex
 }
 
+// TicketLimit describes a limit entry of a ticket (e.g. maximum number of launches for a demo).
+type TicketLimit struct {
+	Type  uint32
+	Value uint32
+}
+
 // Ticket describes the content of a ticket file.
 type Ticket struct {
-	Legit        bool
-	TicketID     Hex64
-	ConsoleID    Hex32
-	TitleID      Hex64
-	TitleKey     TitleKey
-	CertsTrailer bool
+	Legit            bool
+	Environment      Environment
+	SignatureType    SignatureType
+	Version          uint8
+	CACRLVersion     uint8
+	SignerCRLVersion uint8
+	TicketID         Hex64
+	ConsoleID        Hex32
+	TitleID          Hex64
+	TitleVersion     uint16
+	LicenseType      uint8
+	CommonKeyIndex   uint8
+	PropertyMask     Hex16
+	EShopAccountID   Hex32
+	Audit            uint8
+	Limits           []TicketLimit
+	TitleKey         TitleKey
+	CertsTrailer     bool
+	raw              []byte
 }
 
 // CheckTicket reads the given ticket file and verifies its content.
@@ -34,35 +51,79 @@ type Ticket struct {
 // It may be followed by a certificate chain. This notably happens for files downloaded from
 // Nintendo's CDN. If a certificate chain is found, it is checked against expected content.
 //
+// The issuer selects either the retail or the debug certificates, as reported by Environment.
+//
 // A ticket is considered "legit" if its digital signature is properly verified. Unlike other
 // checks, signature checks don't produce errors, but instead expose a Legit boolean to the caller.
 func CheckTicket(input io.Reader) (*Ticket, error) {
+	return CheckTicketWithOptions(input, nil)
+}
+
+// CheckTicketWithOptions is like CheckTicket, but its behavior can be adjusted with the given
+// options. A nil options is equivalent to the zero value.
+func CheckTicketWithOptions(input io.Reader, options *Options) (*Ticket, error) {
+	options = options.orDefault()
 	reader := ctrutil.NewReader(input)
 
-	ticket := make([]byte, 0x350)
-	_, err := io.ReadFull(reader, ticket)
+	rawSignatureType := make([]byte, 0x4)
+	_, err := io.ReadFull(reader, rawSignatureType)
 	if err != nil {
-		return nil, fmt.Errorf("ticket: failed to read ticket: %w", err)
+		return nil, fmt.Errorf("ticket: failed to read signature type: %w", err)
+	}
+
+	signatureType := SignatureType(binary.BigEndian.Uint32(rawSignatureType))
+	signatureLen := signatureType.sectionLen()
+	if signatureLen == 0 {
+		return nil, fmt.Errorf("ticket: unexpected signature type: %s", Hex32(signatureType))
 	}
 
-	signatureType := binary.BigEndian.Uint32(ticket)
-	if signatureType != 0x10004 {
-		return nil, fmt.Errorf("ticket: signature type must be 0x%08x, got 0x%08x", 0x10004, signatureType)
+	ticket := make([]byte, signatureLen+0x210)
+	copy(ticket, rawSignatureType)
+	_, err = io.ReadFull(reader, ticket[0x4:])
+	if err != nil {
+		return nil, fmt.Errorf("ticket: failed to read ticket: %w", err)
 	}
 
-	signature := ticket[0x4:0x104]
-	data := ticket[0x140:]
+	signature := ticket[0x4 : 0x4+signatureType.length()]
+	data := ticket[signatureLen:]
 
 	issuer := string(bytes.TrimRight(data[:0x40], "\x00"))
-	if issuer != fmt.Sprintf("Root-%s-%s", Certs.Retail.CA.Name, Certs.Retail.Ticket.Name) {
-		return nil, fmt.Errorf("ticket: unexpected issuer: %s", issuer)
+	certs := findTicketCertificateSet(issuer)
+	if certs == nil {
+		return nil, &UnexpectedIssuerError{
+			Location: Location{Structure: "ticket", Offset: int64(signatureLen)},
+			Issuer:   issuer,
+		}
 	}
 
-	legit := rsa.VerifyPKCS1v15(&Certs.Retail.Ticket.PublicKey, crypto.SHA256, sha256Hash(data), signature) == nil
+	legit := verifySignature(&certs.Ticket, signatureType, signature, data)
+	if options.RequireLegit && !legit {
+		return nil, fmt.Errorf("ticket: signature is not legit")
+	}
 
+	version := data[0x7c]
+	caCRLVersion := data[0x7d]
+	signerCRLVersion := data[0x7e]
 	ticketID := binary.BigEndian.Uint64(data[0x90:])
 	consoleID := binary.BigEndian.Uint32(data[0x98:])
 	titleID := binary.BigEndian.Uint64(data[0x9c:])
+	titleVersion := binary.BigEndian.Uint16(data[0xa6:])
+	licenseType := data[0xb0]
+	propertyMask := binary.BigEndian.Uint16(data[0xb2:])
+	eShopAccountID := binary.BigEndian.Uint32(data[0xdc:])
+	audit := data[0xe1]
+
+	limits := make([]TicketLimit, 0)
+	for i := 0; i < 8; i++ {
+		limit := data[0x124+i*0x8 : 0x124+(i+1)*0x8]
+		limitType := binary.BigEndian.Uint32(limit)
+		if limitType != 0 {
+			limits = append(limits, TicketLimit{
+				Type:  limitType,
+				Value: binary.BigEndian.Uint32(limit[0x4:]),
+			})
+		}
+	}
 
 	encryptedTitleKey := data[0x7f:0x8f]
 
@@ -83,9 +144,9 @@ func CheckTicket(input io.Reader) (*Ticket, error) {
 	titleKeyDecrypter.CryptBlocks(decryptedTitleKey, encryptedTitleKey)
 
 	certsTrailer := true
-	certs := make([]byte, len(Certs.Retail.CA.Raw)+len(Certs.Retail.Ticket.Raw))
+	trailer := make([]byte, len(certs.CA.Raw)+len(certs.Ticket.Raw))
 
-	_, err = io.ReadFull(reader, certs)
+	_, err = io.ReadFull(reader, trailer)
 	if err == io.EOF {
 		certsTrailer = false
 	} else if err != nil {
@@ -93,33 +154,50 @@ func CheckTicket(input io.Reader) (*Ticket, error) {
 	}
 
 	if certsTrailer {
-		ticketCertLen := len(Certs.Retail.Ticket.Raw)
-		if !bytes.Equal(certs[:ticketCertLen], Certs.Retail.Ticket.Raw) {
+		ticketCertLen := len(certs.Ticket.Raw)
+		if !bytes.Equal(trailer[:ticketCertLen], certs.Ticket.Raw) {
 			return nil, fmt.Errorf("ticket: invalid ticket certificate in trailer")
 		}
 
-		caCertLen := len(Certs.Retail.CA.Raw)
-		if !bytes.Equal(certs[ticketCertLen:ticketCertLen+caCertLen], Certs.Retail.CA.Raw) {
+		caCertLen := len(certs.CA.Raw)
+		if !bytes.Equal(trailer[ticketCertLen:ticketCertLen+caCertLen], certs.CA.Raw) {
 			return nil, fmt.Errorf("ticket: invalid CA certificate in trailer")
 		}
 
-		err = reader.Discard(1)
-		if err == nil {
-			return nil, fmt.Errorf("ticket: extraneous data after %d bytes", reader.Offset()-1)
-		} else if err != io.EOF {
-			return nil, fmt.Errorf("ticket: failed to check extraneous data: %w", err)
+		if !options.AllowExtraneousData {
+			err = reader.Discard(1)
+			if err == nil {
+				return nil, &ExtraneousDataError{
+					Location: Location{Structure: "ticket", Offset: reader.Offset() - 1},
+				}
+			} else if err != io.EOF {
+				return nil, fmt.Errorf("ticket: failed to check extraneous data: %w", err)
+			}
 		}
 	}
 
 	return &Ticket{
-		Legit:     legit,
-		TicketID:  Hex64(ticketID),
-		ConsoleID: Hex32(consoleID),
-		TitleID:   Hex64(titleID),
+		Legit:            legit,
+		Environment:      certs.Environment,
+		SignatureType:    signatureType,
+		Version:          version,
+		CACRLVersion:     caCRLVersion,
+		SignerCRLVersion: signerCRLVersion,
+		TicketID:         Hex64(ticketID),
+		ConsoleID:        Hex32(consoleID),
+		TitleID:          Hex64(titleID),
+		TitleVersion:     titleVersion,
+		LicenseType:      licenseType,
+		CommonKeyIndex:   uint8(commonKeyIndex),
+		PropertyMask:     Hex16(propertyMask),
+		EShopAccountID:   Hex32(eShopAccountID),
+		Audit:            audit,
+		Limits:           limits,
 		TitleKey: TitleKey{
 			Encrypted: encryptedTitleKey,
 			Decrypted: decryptedTitleKey,
 		},
 		CertsTrailer: certsTrailer,
+		raw:          ticket,
 	}, nil
 }
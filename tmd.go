@@ -2,23 +2,36 @@ package ctrsigcheck
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/rsa"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 
 	"github.com/connesc/ctrsigcheck/ctrutil"
 )
 
 // TMD describes a TMD structure.
 type TMD struct {
-	Legit        bool
-	Original     bool
-	TitleID      Hex64
-	TitleVersion uint16
-	Contents     []TMDContent
-	CertsTrailer bool
+	Legit               bool
+	Original            bool
+	Environment         Environment
+	SignatureType       SignatureType
+	Version             uint8
+	CACRLVersion        uint8
+	SignerCRLVersion    uint8
+	SystemVersion       Hex64
+	TitleID             Hex64
+	TitleType           Hex32
+	GroupID             Hex16
+	PublicSaveDataSize  uint32
+	PrivateSaveDataSize uint32
+	SRLFlag             uint8
+	AccessRights        Hex32
+	TitleVersion        uint16
+	BootContent         Hex16
+	Contents            []TMDContent
+	CertsTrailer        bool
+	raw                 []byte
 }
 
 // TMDContent describes a content record in a TMD.
@@ -29,7 +42,10 @@ type TMDContent struct {
 	Size      uint64
 	Hash      Hex
 	Encrypted bool
+	Disc      bool
+	CFM       bool
 	Optional  bool
+	Shared    bool
 }
 
 // CheckTMD reads the given TMD file and verifies its content.
@@ -37,39 +53,74 @@ type TMDContent struct {
 // It may be followed by a certificate chain. This notably happens for files downloaded from
 // Nintendo's CDN. If a certificate chain is found, it is checked against expected content.
 //
+// The issuer selects either the retail or the debug certificates, as reported by Environment.
+//
 // A TMD is considered "legit" if its digital signature is properly verified. Unlike other
 // checks, signature checks don't produce errors, but instead expose a Legit boolean to the caller.
 func CheckTMD(input io.Reader) (*TMD, error) {
+	return CheckTMDWithOptions(input, nil)
+}
+
+// CheckTMDWithOptions is like CheckTMD, but its behavior can be adjusted with the given options.
+// A nil options is equivalent to the zero value.
+func CheckTMDWithOptions(input io.Reader, options *Options) (*TMD, error) {
+	options = options.orDefault()
 	reader := ctrutil.NewReader(input)
 
-	tmdHigh := make([]byte, 0xb04)
-	_, err := io.ReadFull(reader, tmdHigh)
+	rawSignatureType := make([]byte, 0x4)
+	_, err := io.ReadFull(reader, rawSignatureType)
 	if err != nil {
-		return nil, fmt.Errorf("tmd: failed to read first part of TMD: %w", err)
+		return nil, fmt.Errorf("tmd: failed to read signature type: %w", err)
 	}
 
-	signatureType := binary.BigEndian.Uint32(tmdHigh)
-	if signatureType != 0x10004 {
-		return nil, fmt.Errorf("tmd: signature type must be 0x%08x, got 0x%08x", 0x10004, signatureType)
+	signatureType := SignatureType(binary.BigEndian.Uint32(rawSignatureType))
+	signatureLen := signatureType.sectionLen()
+	if signatureLen == 0 {
+		return nil, fmt.Errorf("tmd: unexpected signature type: %s", Hex32(signatureType))
+	}
+
+	tmdHigh := make([]byte, signatureLen+0x9c4)
+	copy(tmdHigh, rawSignatureType)
+	_, err = io.ReadFull(reader, tmdHigh[0x4:])
+	if err != nil {
+		return nil, fmt.Errorf("tmd: failed to read first part of TMD: %w", err)
 	}
 
-	signature := tmdHigh[0x4:0x104]
-	header := tmdHigh[0x140:0x204]
-	contentInfoRecords := tmdHigh[0x204:]
+	signature := tmdHigh[0x4 : 0x4+signatureType.length()]
+	header := tmdHigh[signatureLen : signatureLen+0xc4]
+	contentInfoRecords := tmdHigh[signatureLen+0xc4:]
 
 	issuer := string(bytes.TrimRight(header[:0x40], "\x00"))
-	if issuer != fmt.Sprintf("Root-%s-%s", Certs.Retail.CA.Name, Certs.Retail.TMD.Name) {
-		return nil, fmt.Errorf("tmd: unexpected issuer: %s", issuer)
+	certs := findTMDCertificateSet(issuer)
+	if certs == nil {
+		return nil, &UnexpectedIssuerError{
+			Location: Location{Structure: "tmd", Offset: int64(signatureLen)},
+			Issuer:   issuer,
+		}
 	}
 
-	legit := rsa.VerifyPKCS1v15(&Certs.Retail.TMD.PublicKey, crypto.SHA256, sha256Hash(header), signature) == nil
+	legit := verifySignature(&certs.TMD, signatureType, signature, header)
 
+	version := header[0x40]
+	caCRLVersion := header[0x41]
+	signerCRLVersion := header[0x42]
+	systemVersion := binary.BigEndian.Uint64(header[0x44:])
 	titleID := binary.BigEndian.Uint64(header[0x4c:])
+	titleType := binary.BigEndian.Uint32(header[0x54:])
+	groupID := binary.BigEndian.Uint16(header[0x58:])
+	publicSaveDataSize := binary.LittleEndian.Uint32(header[0x5a:])
+	privateSaveDataSize := binary.LittleEndian.Uint32(header[0x5e:])
+	srlFlag := header[0x66]
+	accessRights := binary.BigEndian.Uint32(header[0x98:])
 	titleVersion := binary.BigEndian.Uint16(header[0x9c:])
 	contentCount := int(binary.BigEndian.Uint16(header[0x9e:]))
+	bootContent := binary.BigEndian.Uint16(header[0xa0:])
 
 	if !bytes.Equal(sha256Hash(contentInfoRecords), header[0xa4:0xc4]) {
-		return nil, fmt.Errorf("tmd: invalid hash for content info records")
+		return nil, &HashMismatchError{
+			Location: Location{Structure: "tmd", Offset: int64(signatureLen + 0xc4)},
+			Subject:  "content info records",
+		}
 	}
 
 	contentChunkRecords := make([]byte, 0x30*contentCount)
@@ -78,6 +129,10 @@ func CheckTMD(input io.Reader) (*TMD, error) {
 		return nil, fmt.Errorf("tmd: failed to read content chunk records: %w", err)
 	}
 
+	raw := make([]byte, 0, len(tmdHigh)+len(contentChunkRecords))
+	raw = append(raw, tmdHigh...)
+	raw = append(raw, contentChunkRecords...)
+
 	contents := make([]TMDContent, 0, contentCount)
 	contentsModified := false
 
@@ -97,7 +152,10 @@ func CheckTMD(input io.Reader) (*TMD, error) {
 		chunkRecordsModified := false
 
 		if !bytes.Equal(sha256Hash(chunkRecords), infoRecord[0x04:0x24]) {
-			return nil, fmt.Errorf("tmd: invalid hash for content chunk records %d to %d", firstChunk, firstChunk+count-1)
+			return nil, &HashMismatchError{
+				Location: Location{Structure: "tmd", Offset: int64(signatureLen + 0x9c4 + 0x30*firstChunk)},
+				Subject:  fmt.Sprintf("content chunk records %d to %d", firstChunk, firstChunk+count-1),
+			}
 		}
 
 		for chunkIndex := 0; chunkIndex < count; chunkIndex++ {
@@ -114,7 +172,6 @@ func CheckTMD(input io.Reader) (*TMD, error) {
 			}
 
 			encrypted := contentType&0x0001 != 0
-			optional := contentType&0x4000 != 0
 
 			contents = append(contents, TMDContent{
 				ID:        Hex32(contentID),
@@ -123,7 +180,10 @@ func CheckTMD(input io.Reader) (*TMD, error) {
 				Size:      contentSize,
 				Hash:      contentHash,
 				Encrypted: encrypted,
-				Optional:  optional,
+				Disc:      contentType&0x0002 != 0,
+				CFM:       contentType&0x0004 != 0,
+				Optional:  contentType&0x4000 != 0,
+				Shared:    contentType&0x8000 != 0,
 			})
 
 			if !legit && !encrypted {
@@ -144,13 +204,17 @@ func CheckTMD(input io.Reader) (*TMD, error) {
 
 	if contentsModified {
 		copy(header[0xa4:0xc4], sha256Hash(contentInfoRecords))
-		legit = rsa.VerifyPKCS1v15(&Certs.Retail.TMD.PublicKey, crypto.SHA256, sha256Hash(header), signature) == nil
+		legit = verifySignature(&certs.TMD, signatureType, signature, header)
+	}
+
+	if options.RequireLegit && !legit {
+		return nil, fmt.Errorf("tmd: signature is not legit")
 	}
 
 	certsTrailer := true
-	certs := make([]byte, len(Certs.Retail.CA.Raw)+len(Certs.Retail.TMD.Raw))
+	trailer := make([]byte, len(certs.CA.Raw)+len(certs.TMD.Raw))
 
-	_, err = io.ReadFull(reader, certs)
+	_, err = io.ReadFull(reader, trailer)
 	if err == io.EOF {
 		certsTrailer = false
 	} else if err != nil {
@@ -158,30 +222,142 @@ func CheckTMD(input io.Reader) (*TMD, error) {
 	}
 
 	if certsTrailer {
-		tmdCertLen := len(Certs.Retail.TMD.Raw)
-		if !bytes.Equal(certs[:tmdCertLen], Certs.Retail.TMD.Raw) {
+		tmdCertLen := len(certs.TMD.Raw)
+		if !bytes.Equal(trailer[:tmdCertLen], certs.TMD.Raw) {
 			return nil, fmt.Errorf("tmd: invalid TMD certificate in trailer")
 		}
 
-		caCertLen := len(Certs.Retail.CA.Raw)
-		if !bytes.Equal(certs[tmdCertLen:tmdCertLen+caCertLen], Certs.Retail.CA.Raw) {
+		caCertLen := len(certs.CA.Raw)
+		if !bytes.Equal(trailer[tmdCertLen:tmdCertLen+caCertLen], certs.CA.Raw) {
 			return nil, fmt.Errorf("tmd: invalid CA certificate in trailer")
 		}
 
-		err = reader.Discard(1)
-		if err == nil {
-			return nil, fmt.Errorf("tmd: extraneous data after %d bytes", reader.Offset()-1)
-		} else if err != io.EOF {
-			return nil, fmt.Errorf("tmd: failed to check extraneous data: %w", err)
+		if !options.AllowExtraneousData {
+			err = reader.Discard(1)
+			if err == nil {
+				return nil, &ExtraneousDataError{
+					Location: Location{Structure: "tmd", Offset: reader.Offset() - 1},
+				}
+			} else if err != io.EOF {
+				return nil, fmt.Errorf("tmd: failed to check extraneous data: %w", err)
+			}
 		}
 	}
 
 	return &TMD{
-		Legit:        legit,
-		Original:     legit && !contentsModified,
-		TitleID:      Hex64(titleID),
-		TitleVersion: titleVersion,
-		Contents:     contents,
-		CertsTrailer: certsTrailer,
+		Legit:               legit,
+		Original:            legit && !contentsModified,
+		Environment:         certs.Environment,
+		SignatureType:       signatureType,
+		Version:             version,
+		CACRLVersion:        caCRLVersion,
+		SignerCRLVersion:    signerCRLVersion,
+		SystemVersion:       Hex64(systemVersion),
+		TitleID:             Hex64(titleID),
+		TitleType:           Hex32(titleType),
+		GroupID:             Hex16(groupID),
+		PublicSaveDataSize:  publicSaveDataSize,
+		PrivateSaveDataSize: privateSaveDataSize,
+		SRLFlag:             srlFlag,
+		AccessRights:        Hex32(accessRights),
+		TitleVersion:        titleVersion,
+		BootContent:         Hex16(bootContent),
+		Contents:            contents,
+		CertsTrailer:        certsTrailer,
+		raw:                 raw,
 	}, nil
 }
+
+// rewriteTMDContentTypes returns a copy of the given raw TMD, in which the type of each content
+// is replaced by the result of rewrite. The hashes of content info records and chunk records are
+// updated accordingly, but the signature is left untouched.
+func rewriteTMDContentTypes(raw []byte, rewrite func(content *TMDContent) Hex16) []byte {
+	raw = append([]byte(nil), raw...)
+
+	signatureLen := SignatureType(binary.BigEndian.Uint32(raw)).sectionLen()
+	header := raw[signatureLen : signatureLen+0xc4]
+	contentInfoRecords := raw[signatureLen+0xc4 : signatureLen+0x9c4]
+	contentChunkRecords := raw[signatureLen+0x9c4:]
+
+	firstChunk := 0
+	for infoIndex := 0; infoIndex < 64; infoIndex++ {
+		infoRecord := contentInfoRecords[infoIndex*0x24 : (infoIndex+1)*0x24]
+		count := int(binary.BigEndian.Uint16(infoRecord[0x2:]))
+		if count == 0 {
+			continue
+		}
+
+		chunkRecords := contentChunkRecords[0x30*firstChunk : 0x30*(firstChunk+count)]
+		for chunkIndex := 0; chunkIndex < count; chunkIndex++ {
+			chunkRecord := chunkRecords[chunkIndex*0x30 : (chunkIndex+1)*0x30]
+			contentType := binary.BigEndian.Uint16(chunkRecord[0x6:])
+			content := &TMDContent{
+				ID:        Hex32(binary.BigEndian.Uint32(chunkRecord)),
+				Index:     Hex16(binary.BigEndian.Uint16(chunkRecord[0x4:])),
+				Type:      Hex16(contentType),
+				Size:      binary.BigEndian.Uint64(chunkRecord[0x8:]),
+				Hash:      chunkRecord[0x10:0x30],
+				Encrypted: contentType&0x0001 != 0,
+				Disc:      contentType&0x0002 != 0,
+				CFM:       contentType&0x0004 != 0,
+				Optional:  contentType&0x4000 != 0,
+				Shared:    contentType&0x8000 != 0,
+			}
+			binary.BigEndian.PutUint16(chunkRecord[0x6:], uint16(rewrite(content)))
+		}
+
+		copy(infoRecord[0x04:0x24], sha256Hash(chunkRecords))
+		firstChunk += count
+	}
+
+	copy(header[0xa4:0xc4], sha256Hash(contentInfoRecords))
+	return raw
+}
+
+// originalRaw returns the raw TMD in its original form, in which the encrypted bits that have
+// been cleared on decryption are restored. It returns nil if the original form has not been
+// recognized.
+func (tmd *TMD) originalRaw() []byte {
+	if tmd.Original {
+		return tmd.raw
+	}
+	if !tmd.Legit {
+		return nil
+	}
+	return rewriteTMDContentTypes(tmd.raw, func(content *TMDContent) Hex16 {
+		return content.Type | 0x0001
+	})
+}
+
+// RestoreTMD reads the given TMD file and returns it in its original form.
+//
+// Some tools clear the encrypted bits of content chunk records when decrypting contents, and
+// update the hashes accordingly. Since the signature is left untouched, such a TMD is reported as
+// legit but not original by CheckTMD. This function restores the original bytes, followed by the
+// rest of the given file (e.g. the certificate chain) as is. A TMD that is already original is
+// returned unchanged. An error is returned if the original form cannot be recognized.
+func RestoreTMD(input io.Reader) ([]byte, error) {
+	return RestoreTMDWithOptions(input, nil)
+}
+
+// RestoreTMDWithOptions is like RestoreTMD, but its behavior can be adjusted with the given
+// options. A nil options is equivalent to the zero value. Extraneous data, if allowed, is
+// preserved.
+func RestoreTMDWithOptions(input io.Reader, options *Options) ([]byte, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, fmt.Errorf("tmd: failed to read: %w", err)
+	}
+
+	tmd, err := CheckTMDWithOptions(bytes.NewReader(data), options)
+	if err != nil {
+		return nil, err
+	}
+
+	original := tmd.originalRaw()
+	if original == nil {
+		return nil, fmt.Errorf("tmd: original form not recognized")
+	}
+
+	return append(append([]byte(nil), original...), data[len(tmd.raw):]...), nil
+}